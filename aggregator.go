@@ -1,8 +1,13 @@
 package metricize
 
 import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/elastic/go-hdrhistogram"
 )
 
@@ -15,6 +20,12 @@ const (
 type transactionMetrics struct {
 	earliest, latest time.Time
 	hist             *hdrhistogram.Histogram
+	// observer is taken from the latest document aggregated, the last aggregated of equally late ones.
+	observer Observer
+	// sum and count summarize the durations recorded. They are derived from the source histograms, the only
+	// durations aggs mode reads, rather than taken from the summaries of the source documents.
+	sum   float64
+	count int64
 }
 
 /*
@@ -56,9 +67,19 @@ func (t *transactionMetrics) Emit() DurationHistogram {
 	}
 }
 
+// Aggregator merges transaction metrics sharing the same aggregation key.
+// Aggregate and AggregateGroup are safe for concurrent use.
 type Aggregator struct {
+	mu      sync.Mutex
 	start   time.Time
 	Buckets map[transactionAggregationKey]*transactionMetrics
+	// observerVersions holds every observer version seen, across all keys.
+	observerVersions map[string]struct{}
+	// docs counts the source documents aggregated.
+	docs int64
+	// transactions sums the _doc_count of the source documents, the number of transactions apm-server summarized
+	// in each, counting documents without one once as Elasticsearch does.
+	transactions int64
 }
 
 type aggKeyDims struct {
@@ -97,6 +118,49 @@ type aggKeyDims struct {
 	traceRoot              bool
 }
 
+// keyFields lists the document fields populating aggKeyDims, see newTransactionAggregationKey.
+var keyFields = []string{
+	"agent.name",
+	"host.os.platform",
+	"kubernetes.pod.name",
+	"cloud.provider",
+	"cloud.region",
+	"cloud.availability_zone",
+	"cloud.account.id",
+	"cloud.account.name",
+	"cloud.machine.type",
+	"cloud.project.id",
+	"cloud.project.name",
+	"service.environment",
+	"service.name",
+	"service.version",
+	"service.node.name",
+	"service.runtime.name",
+	"service.runtime.version",
+	"service.language.name",
+	"service.language.version",
+	"transaction.name",
+	"transaction.result",
+	"transaction.type",
+	"event.outcome",
+	"host.hostname",
+	"host.name",
+	"container.id",
+	"transaction.root",
+}
+
+// KeyFields returns the document fields transaction metrics are grouped by.
+func KeyFields() []string {
+	return append([]string(nil), keyFields...)
+}
+
+// SourceFields returns the document fields required to aggregate a MetricDoc,
+// suitable for limiting what is fetched from Elasticsearch.
+// _doc_count is among them as apm-server sets it to the number of transactions each document summarizes.
+func SourceFields() []string {
+	return append(KeyFields(), "@timestamp", "_doc_count", "transaction.duration.histogram", "observer.hostname", "observer.type", "observer.version")
+}
+
 type transactionAggregationKey struct {
 	//labels.AggregatedGlobalLabels
 	aggKeyDims
@@ -180,16 +244,29 @@ func (t *transactionAggregationKey) Emit(start time.Time, dh DurationHistogram)
 }
 
 func NewAggregator(start time.Time) *Aggregator {
-	return &Aggregator{start: start, Buckets: make(map[transactionAggregationKey]*transactionMetrics)}
+	return &Aggregator{
+		start:            start,
+		Buckets:          make(map[transactionAggregationKey]*transactionMetrics),
+		observerVersions: make(map[string]struct{}),
+	}
 }
 
 func (a *Aggregator) Aggregate(doc *MetricDoc) error {
+	return a.AggregateGroup(doc, 1)
+}
+
+// AggregateGroup aggregates doc as the sum of docs source documents, such as a composite aggregation bucket,
+// whose _doc_count doc.DocCount sums.
+func (a *Aggregator) AggregateGroup(doc *MetricDoc, docs int64) error {
 	key := newTransactionAggregationKey(doc)
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	bucket, ok := a.Buckets[key]
 	if !ok {
 		bucket = &transactionMetrics{
 			earliest: doc.Timestamp,
 			latest:   doc.Timestamp,
+			observer: doc.Observer,
 			hist: hdrhistogram.New(
 				minDuration.Microseconds(),
 				maxDuration.Microseconds(),
@@ -201,18 +278,73 @@ func (a *Aggregator) Aggregate(doc *MetricDoc) error {
 		if doc.Timestamp.Before(bucket.earliest) {
 			bucket.earliest = doc.Timestamp
 		}
-		if doc.Timestamp.After(bucket.latest) {
+		if !doc.Timestamp.Before(bucket.latest) {
 			bucket.latest = doc.Timestamp
+			bucket.observer = doc.Observer
 		}
 	}
+	if doc.Observer.Version != "" {
+		a.observerVersions[doc.Observer.Version] = struct{}{}
+	}
+	a.docs += docs
+	if doc.DocCount > 0 {
+		a.transactions += doc.DocCount
+	} else {
+		a.transactions += docs
+	}
 	for i, v := range doc.Transaction.DurationHistogram.Values {
-		if err := bucket.hist.RecordValues(v, doc.Transaction.DurationHistogram.Counts[i]); err != nil {
+		c := doc.Transaction.DurationHistogram.Counts[i]
+		if err := bucket.hist.RecordValues(v, c); err != nil {
 			return err
 		}
+		bucket.sum += float64(v) * float64(c)
+		bucket.count += c
 	}
 	return nil
 }
 
+// Emit returns the rollup document for key, carrying the observer of the latest document aggregated under it and
+// the summary of every duration aggregated.
 func (a *Aggregator) Emit(key transactionAggregationKey) MetricDoc {
-	return key.Emit(a.start, a.Buckets[key].Emit())
+	bucket := a.Buckets[key]
+	m := key.Emit(a.start, bucket.Emit())
+	m.Observer = bucket.observer
+	m.Transaction.DurationSummary = &DurationSummary{Sum: bucket.sum, ValueCount: bucket.count}
+	return m
+}
+
+// Docs returns the number of source documents aggregated.
+func (a *Aggregator) Docs() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.docs
+}
+
+// Transactions returns the sum of the _doc_count of the source documents aggregated.
+func (a *Aggregator) Transactions() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.transactions
+}
+
+// ObserverVersions returns the distinct observer versions of the documents aggregated, in sorted order.
+func (a *Aggregator) ObserverVersions() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	versions := make([]string, 0, len(a.observerVersions))
+	for v := range a.observerVersions {
+		versions = append(versions, v)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// DocumentID returns a deterministic identifier for the rollup of key covering period seconds,
+// so that rewriting the same rollup produces the same document.
+func (a *Aggregator) DocumentID(key transactionAggregationKey, period int64) string {
+	dims, _ := json.Marshal(key.Emit(a.start, DurationHistogram{}))
+	h := xxhash.New()
+	h.WriteString(strconv.FormatInt(period, 10))
+	h.Write(dims)
+	return strconv.FormatUint(h.Sum64(), 16)
 }
@@ -1,9 +1,11 @@
 package metricize
 
 import (
-	"github.com/stretchr/testify/require"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestAggregateSingle(t *testing.T) {
@@ -49,4 +51,114 @@ func TestAggregateMultiple(t *testing.T) {
 		require.NoError(t, a.Aggregate(doc))
 	}
 	require.Len(t, a.Buckets, 2)
+	require.EqualValues(t, 3, a.Docs())
+	require.EqualValues(t, 3, a.Transactions())
+
+	doc.DocCount = 5
+	require.NoError(t, a.Aggregate(doc))
+	require.EqualValues(t, 4, a.Docs())
+	require.EqualValues(t, 8, a.Transactions())
+
+	// a group of documents, some without _doc_count
+	doc.DocCount = 7
+	require.NoError(t, a.AggregateGroup(doc, 3))
+	require.EqualValues(t, 7, a.Docs())
+	require.EqualValues(t, 15, a.Transactions())
+}
+
+func TestAggregateConcurrent(t *testing.T) {
+	a := NewAggregator(time.Time{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				doc := &MetricDoc{
+					Transaction: Transaction{
+						Name: "GET /",
+						DurationHistogram: DurationHistogram{
+							Counts: []int64{1},
+							Values: []int64{100},
+						},
+					},
+				}
+				require.NoError(t, a.Aggregate(doc))
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Len(t, a.Buckets, 1)
+	for _, bucket := range a.Buckets {
+		require.Equal(t, int64(400), bucket.hist.TotalCount())
+	}
+}
+
+func TestAggregateObserver(t *testing.T) {
+	doc := &MetricDoc{
+		Timestamp: time.Unix(60, 0),
+		Observer:  Observer{Hostname: "apm-1", Type: "apm-server", Version: "8.5.2"},
+		Transaction: Transaction{
+			Name: "GET /",
+			DurationHistogram: DurationHistogram{
+				Counts: []int64{1},
+				Values: []int64{1},
+			},
+		},
+	}
+	a := NewAggregator(time.Time{})
+	require.NoError(t, a.Aggregate(doc))
+	later := *doc
+	later.Timestamp = time.Unix(120, 0)
+	later.Observer = Observer{Hostname: "apm-2", Type: "apm-server", Version: "8.6.0"}
+	require.NoError(t, a.Aggregate(&later))
+	// an earlier document does not replace the observer
+	require.NoError(t, a.Aggregate(doc))
+
+	require.Len(t, a.Buckets, 1)
+	for key := range a.Buckets {
+		require.Equal(t, later.Observer, a.Emit(key).Observer)
+	}
+	require.Equal(t, []string{"8.5.2", "8.6.0"}, a.ObserverVersions())
+}
+
+func TestKeyFields(t *testing.T) {
+	// every key field must contribute to the aggregation key
+	for _, field := range KeyFields() {
+		var value interface{} = field
+		if field == "transaction.root" {
+			value = true
+		}
+		doc, err := MetricDocFromFields(map[string]interface{}{field: value})
+		require.NoError(t, err)
+		require.NotEqual(t, transactionAggregationKey{}, newTransactionAggregationKey(&doc), field)
+	}
+}
+
+func TestDocumentID(t *testing.T) {
+	doc := &MetricDoc{
+		Transaction: Transaction{
+			Name: "GET /",
+			DurationHistogram: DurationHistogram{
+				Counts: []int64{1},
+				Values: []int64{1},
+			},
+		},
+	}
+	a := NewAggregator(time.Unix(600, 0))
+	require.NoError(t, a.Aggregate(doc))
+	doc.Transaction.Name = "POST /"
+	require.NoError(t, a.Aggregate(doc))
+	require.Len(t, a.Buckets, 2)
+
+	ids := make(map[string]bool)
+	for key := range a.Buckets {
+		id := a.DocumentID(key, 600)
+		require.Equal(t, id, a.DocumentID(key, 600))
+		ids[id] = true
+		ids[a.DocumentID(key, 60)] = true
+		ids[NewAggregator(time.Unix(1200, 0)).DocumentID(key, 600)] = true
+	}
+	require.Len(t, ids, 6)
 }
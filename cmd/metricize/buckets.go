@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// bucketFunc processes the rollup for the interval starting at bucket (unix seconds).
+// Anything it logs through logger is buffered and written out in bucket order.
+type bucketFunc func(ctx context.Context, logger *log.Logger, bucket int64) error
+
+type bucketResult struct {
+	buf  bytes.Buffer
+	err  error
+	done chan struct{}
+}
+
+// processBuckets runs fn for every bucket using at most workers concurrent goroutines.
+// Log output is emitted in bucket order regardless of completion order.
+// Unless continueOnError is set, the first failure cancels all outstanding work and is returned.
+func processBuckets(ctx context.Context, buckets []int64, workers int, continueOnError bool, fn bucketFunc) error {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]*bucketResult, len(buckets))
+	for i := range results {
+		results[i] = &bucketResult{done: make(chan struct{})}
+	}
+
+	// cause is the failure that triggered cancellation in fail-fast mode
+	var (
+		causeOnce sync.Once
+		cause     error
+	)
+
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range buckets {
+			jobs <- i
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				r := results[i]
+				if err := ctx.Err(); err != nil {
+					r.err = err
+				} else {
+					logger := log.New(&r.buf, "", log.Flags())
+					if err := fn(ctx, logger, buckets[i]); err != nil {
+						r.err = fmt.Errorf("while processing %s: %w", time.Unix(buckets[i], 0).String(), err)
+						if !continueOnError {
+							causeOnce.Do(func() { cause = r.err })
+							cancel()
+						}
+					}
+				}
+				close(r.done)
+			}
+		}()
+	}
+
+	var (
+		firstErr error
+		failed   int
+	)
+	for _, r := range results {
+		<-r.done
+		log.Writer().Write(r.buf.Bytes())
+		if r.err == nil || errors.Is(r.err, context.Canceled) && ctx.Err() != nil {
+			continue
+		}
+		if firstErr == nil {
+			firstErr = r.err
+		}
+		failed++
+		if continueOnError {
+			log.Println(r.err)
+		}
+	}
+	wg.Wait()
+
+	if cause != nil {
+		return cause
+	}
+	if firstErr == nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("%d of %d buckets failed, first error: %w", failed, len(buckets), firstErr)
+}
+
+// followBuckets runs fn for next and every following bucket once it is complete, until ctx is done.
+// As with the initial run, a bucket is only processed after the bucket following it has ended too,
+// since the current bucket could still be written to.
+func followBuckets(ctx context.Context, next, step int64, continueOnError bool, fn bucketFunc) error {
+	for ; ; next += step {
+		timer := time.NewTimer(time.Until(time.Unix(next+2*step, 0)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		// failures are logged by processBuckets when continuing on error
+		if err := processBuckets(ctx, []int64{next}, 1, continueOnError, fn); err != nil && !continueOnError {
+			return err
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// captureLog redirects the standard logger, without timestamps, for the duration of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	out, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(out)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+func TestProcessBucketsLogOrder(t *testing.T) {
+	logs := captureLog(t)
+	buckets := []int64{0, 600, 1200, 1800}
+	// every bucket but the last waits for the one after it, so that workers finish in reverse order
+	finished := make([]chan struct{}, len(buckets))
+	for i := range finished {
+		finished[i] = make(chan struct{})
+	}
+	err := processBuckets(context.Background(), buckets, len(buckets), false, func(_ context.Context, logger *log.Logger, bucket int64) error {
+		i := int(bucket / 600)
+		if i+1 < len(buckets) {
+			<-finished[i+1]
+		}
+		logger.Printf("bucket %d", bucket)
+		close(finished[i])
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "bucket 0\nbucket 600\nbucket 1200\nbucket 1800\n", logs.String())
+}
+
+func TestProcessBucketsFailFast(t *testing.T) {
+	captureLog(t)
+	var mu sync.Mutex
+	var ran []int64
+	failure := errors.New("failure")
+	err := processBuckets(context.Background(), []int64{0, 600, 1200, 1800}, 1, false, func(ctx context.Context, _ *log.Logger, bucket int64) error {
+		mu.Lock()
+		ran = append(ran, bucket)
+		mu.Unlock()
+		if bucket == 600 {
+			return failure
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, failure)
+	// buckets after the failure are cancelled rather than run
+	require.Equal(t, []int64{0, 600}, ran)
+}
+
+func TestProcessBucketsFailFastCancels(t *testing.T) {
+	captureLog(t)
+	failure := errors.New("failure")
+	err := processBuckets(context.Background(), []int64{0, 600}, 2, false, func(ctx context.Context, _ *log.Logger, bucket int64) error {
+		if bucket == 600 {
+			return failure
+		}
+		// the bucket in progress sees its context cancelled
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return errors.New("not cancelled")
+		}
+	})
+	require.ErrorIs(t, err, failure)
+}
+
+func TestProcessBucketsContinueOnError(t *testing.T) {
+	logs := captureLog(t)
+	var mu sync.Mutex
+	var ran []int64
+	err := processBuckets(context.Background(), []int64{0, 600, 1200, 1800}, 2, true, func(_ context.Context, _ *log.Logger, bucket int64) error {
+		mu.Lock()
+		ran = append(ran, bucket)
+		mu.Unlock()
+		if bucket == 0 || bucket == 1200 {
+			return fmt.Errorf("failure %d", bucket)
+		}
+		return nil
+	})
+	require.Error(t, err)
+	require.ElementsMatch(t, []int64{0, 600, 1200, 1800}, ran)
+	require.Contains(t, err.Error(), "2 of 4 buckets failed")
+	require.Contains(t, err.Error(), "failure 0")
+	// every failure is logged, in bucket order
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], "failure 0")
+	require.Contains(t, lines[1], "failure 1200")
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/elastic-transport-go/v8/elastictransport"
+	esv8 "github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+
+	"github.com/graphaelli/metricize"
+)
+
+// bulkConfig controls how documents are written to Elasticsearch.
+type bulkConfig struct {
+	// FlushBytes is the request body size triggering a flush.
+	FlushBytes int
+	// FlushInterval is the longest a partially filled request is held before flushing, which is also how long
+	// writing a rollup smaller than FlushBytes waits for its last documents to be sent.
+	FlushInterval time.Duration
+	// Workers is the number of concurrent bulk requests.
+	Workers int
+	// DeterministicIDs treats documents rejected as already existing as written.
+	DeterministicIDs bool
+	Retry            retryConfig
+}
+
+// bulkWriter indexes documents through an esutil.BulkIndexer shared by all buckets and targets,
+// retrying items rejected with 429s and tracking the outcome of every document.
+type bulkWriter struct {
+	indexer esutil.BulkIndexer
+	cfg     bulkConfig
+
+	// brokenMu guards broken, the breakage batches started now are failed by, replaced once it happens
+	brokenMu sync.Mutex
+	broken   *bulkBreakage
+	// mu guards closed, set once the indexer is closing, after which retries can no longer be added
+	mu     sync.RWMutex
+	closed bool
+	// retries tracks the goroutines retrying rejected documents
+	retries sync.WaitGroup
+
+	indexed, existing, failed, retried, sent uint64
+}
+
+// bulkBreakage is a request level error reported by the indexer, after which the outcome of the documents
+// outstanding at the time is unknown: the indexer does not report on the items of a failed request.
+type bulkBreakage struct {
+	done chan struct{}
+	err  error
+}
+
+// bulkBatch tracks the documents added to a bulkWriter for a single rollup.
+type bulkBatch struct {
+	wg       sync.WaitGroup
+	broken   *bulkBreakage
+	indexed  int64
+	existing int64
+	failures bulkFailures
+}
+
+// newBulkWriter creates a writer indexing through es, instrumenting its transport to count the bytes of bulk
+// requests sent.
+func newBulkWriter(es *esv8.Client, cfg bulkConfig) (*bulkWriter, error) {
+	w := &bulkWriter{
+		cfg:    cfg,
+		broken: &bulkBreakage{done: make(chan struct{})},
+	}
+	es.Transport = &countingTransport{Interface: es.Transport, sent: &w.sent}
+	indexer, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
+		Client:        es,
+		NumWorkers:    cfg.Workers,
+		FlushBytes:    cfg.FlushBytes,
+		FlushInterval: cfg.FlushInterval,
+		OnFlushStart: func(ctx context.Context) context.Context {
+			return context.WithValue(ctx, flushingKey{}, true)
+		},
+		OnError: func(ctx context.Context, err error) {
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return
+			}
+			if ctx.Value(flushingKey{}) != nil {
+				// reported again by the caller of the flush
+				return
+			}
+			// fail the batches outstanding, those started from now on get a clean slate
+			w.brokenMu.Lock()
+			broken := w.broken
+			w.broken = &bulkBreakage{done: make(chan struct{})}
+			w.brokenMu.Unlock()
+			broken.err = fmt.Errorf("bulk indexing failed: %w", err)
+			close(broken.done)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.indexer = indexer
+	return w, nil
+}
+
+// flushingKey marks the context of a flush. The indexer reports a failed flush twice, from within the flush and
+// with the full response from the code calling it.
+type flushingKey struct{}
+
+// countingTransport counts the body bytes of the bulk requests performed, as sent after any compression.
+type countingTransport struct {
+	elastictransport.Interface
+	sent *uint64
+}
+
+func (t *countingTransport) Perform(req *http.Request) (*http.Response, error) {
+	rsp, err := t.Interface.Perform(req)
+	// the transport compresses the body in place, updating the content length
+	if err == nil && strings.HasSuffix(req.URL.Path, "/_bulk") && req.ContentLength > 0 {
+		atomic.AddUint64(t.sent, uint64(req.ContentLength))
+	}
+	return rsp, err
+}
+
+// begin starts tracking a batch of documents.
+func (w *bulkWriter) begin() *bulkBatch {
+	w.brokenMu.Lock()
+	defer w.brokenMu.Unlock()
+	return &bulkBatch{broken: w.broken}
+}
+
+// add queues doc for creation in index, with the given id unless empty.
+func (w *bulkWriter) add(ctx context.Context, batch *bulkBatch, index, id string, doc []byte) error {
+	batch.wg.Add(1)
+	if err := w.add1(ctx, batch, index, id, doc, 0); err != nil {
+		batch.wg.Done()
+		return err
+	}
+	return nil
+}
+
+func (w *bulkWriter) add1(ctx context.Context, batch *bulkBatch, index, id string, doc []byte, attempt int) error {
+	return w.indexer.Add(ctx, esutil.BulkIndexerItem{
+		Index:      index,
+		Action:     "create",
+		DocumentID: id,
+		Body:       bytes.NewReader(doc),
+		OnSuccess: func(context.Context, esutil.BulkIndexerItem, esutil.BulkIndexerResponseItem) {
+			atomic.AddUint64(&w.indexed, 1)
+			atomic.AddInt64(&batch.indexed, 1)
+			batch.wg.Done()
+		},
+		OnFailure: func(_ context.Context, _ esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
+			switch {
+			case err == nil && res.Status == http.StatusTooManyRequests && attempt < w.cfg.Retry.MaxRetries:
+				atomic.AddUint64(&w.retried, 1)
+				// retry from another goroutine, the indexer's workers must not block on Add
+				w.retries.Add(1)
+				go func() {
+					defer w.retries.Done()
+					if err := w.cfg.Retry.wait(ctx, attempt+1); err == nil {
+						if err = w.retry(ctx, batch, index, id, doc, attempt+1); err == nil {
+							return
+						}
+					}
+					w.fail(batch, res, err, doc)
+				}()
+				return
+			case err == nil && w.cfg.DeterministicIDs && isAlreadyExists(res):
+				// written by an earlier run
+				atomic.AddUint64(&w.existing, 1)
+				atomic.AddInt64(&batch.existing, 1)
+				batch.wg.Done()
+			default:
+				w.fail(batch, res, err, doc)
+			}
+		},
+	})
+}
+
+// retry adds doc again, unless the indexer is closing.
+func (w *bulkWriter) retry(ctx context.Context, batch *bulkBatch, index, id string, doc []byte, attempt int) error {
+	// hold the read lock while adding so that close cannot close the indexer's queue in between
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return errors.New("bulk writer closed before the document could be retried")
+	}
+	return w.add1(ctx, batch, index, id, doc, attempt)
+}
+
+// fail records doc as failed for good, described by res or err if set.
+func (w *bulkWriter) fail(batch *bulkBatch, res esutil.BulkIndexerResponseItem, err error, doc []byte) {
+	if err != nil {
+		res.Error.Type = "error"
+		res.Error.Reason = err.Error()
+	}
+	atomic.AddUint64(&w.failed, 1)
+	batch.failures.add(res, doc)
+	batch.wg.Done()
+}
+
+// wait blocks until every document added to batch succeeded or failed, or a request failed while they were
+// outstanding.
+func (w *bulkWriter) wait(ctx context.Context, batch *bulkBatch) error {
+	done := make(chan struct{})
+	go func() {
+		batch.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-batch.broken.done:
+		return batch.broken.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close flushes outstanding documents and stops the indexer, once retries still pending have given up.
+func (w *bulkWriter) close(ctx context.Context) error {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	batch := w.begin()
+	err := w.indexer.Close(ctx)
+	w.retries.Wait()
+	if err != nil {
+		return err
+	}
+	select {
+	case <-batch.broken.done:
+		return batch.broken.err
+	default:
+		return nil
+	}
+}
+
+// stats summarizes everything written.
+func (w *bulkWriter) stats() string {
+	return fmt.Sprintf("%d docs indexed, %d already present, %d failed, %d retries after rejection, %d bytes sent in %d bulk requests",
+		atomic.LoadUint64(&w.indexed), atomic.LoadUint64(&w.existing), atomic.LoadUint64(&w.failed),
+		atomic.LoadUint64(&w.retried), atomic.LoadUint64(&w.sent), w.indexer.Stats().NumRequests)
+}
+
+// write indexes a document for every bucket of a into the target data stream and waits for them to be indexed.
+func (w *bulkWriter) write(ctx context.Context, logger *log.Logger, info *rollupInfo, a *metricize.Aggregator) error {
+	targetIndex, period := info.Target.String(), info.Period
+	batch := w.begin()
+	for key := range a.Buckets {
+		doc := a.Emit(key)
+		info.decorate(&doc)
+		b, err := json.Marshal(&doc)
+		if err != nil {
+			return err
+		}
+		var id string
+		if w.cfg.DeterministicIDs {
+			id = a.DocumentID(key, period)
+		}
+		if err := w.add(ctx, batch, targetIndex, id, b); err != nil {
+			return err
+		}
+	}
+	if err := w.wait(ctx, batch); err != nil {
+		return err
+	}
+	if n := batch.failures.len(); n > 0 {
+		logger.Print(batch.failures.summary())
+		return fmt.Errorf("bulk indexing failed for %d of %d docs", n, len(a.Buckets))
+	}
+	if batch.existing > 0 {
+		logger.Printf("Skipped %d metrics docs already present in %s", batch.existing, targetIndex)
+	}
+	logger.Printf("Indexed %d metrics docs into %s", batch.indexed, targetIndex)
+	return nil
+}
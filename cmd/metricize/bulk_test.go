@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	esv8 "github.com/elastic/go-elasticsearch/v8"
+	"github.com/stretchr/testify/require"
+
+	"github.com/graphaelli/metricize"
+)
+
+// fakeBulk answers bulk requests with status for every request, as long as it is set, and item status for
+// every item, creating it otherwise.
+type fakeBulk struct {
+	mu         sync.Mutex
+	status     []int
+	itemStatus []int
+	requests   int
+	received   uint64
+}
+
+func (f *fakeBulk) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	f.received += uint64(r.ContentLength)
+	if len(f.status) > 0 {
+		status := f.status[0]
+		f.status = f.status[1:]
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"error":{"type":"failure","reason":"status %d"},"status":%d}`, status, status)
+		return
+	}
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = gz
+	}
+	var items []map[string]interface{}
+	scanner := bufio.NewScanner(body)
+	for i := 0; scanner.Scan(); i++ {
+		if i%2 == 1 {
+			continue
+		}
+		status := http.StatusCreated
+		if len(f.itemStatus) > 0 {
+			status = f.itemStatus[0]
+			f.itemStatus = f.itemStatus[1:]
+		}
+		item := map[string]interface{}{"_index": "metrics-apm.internal-rollup10m0s", "status": status}
+		if status >= 300 {
+			item["error"] = map[string]interface{}{"type": "es_rejected_execution_exception", "reason": "rejected"}
+		}
+		items = append(items, map[string]interface{}{"create": item})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"took": 1, "errors": false, "items": items})
+}
+
+func newTestBulkWriter(t *testing.T, f *fakeBulk) *bulkWriter {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		f.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	es, err := esv8.NewClient(esv8.Config{Addresses: []string{srv.URL}, CompressRequestBody: true, DisableRetry: true})
+	require.NoError(t, err)
+	w, err := newBulkWriter(es, bulkConfig{
+		FlushBytes:    1 << 20,
+		FlushInterval: 10 * time.Millisecond,
+		Workers:       1,
+		Retry:         retryConfig{MaxRetries: 2, Backoff: time.Millisecond, MaxBackoff: time.Millisecond},
+	})
+	require.NoError(t, err)
+	return w
+}
+
+func testRollup(t *testing.T, services int) (*rollupInfo, *metricize.Aggregator) {
+	start := time.Unix(1670000400, 0)
+	a := metricize.NewAggregator(start)
+	for _, doc := range sourceDocs(start, services, services) {
+		require.NoError(t, a.Aggregate(&doc))
+	}
+	target, err := targetConfig{Type: "metrics", Dataset: "apm.transaction_rollup.{{.Interval}}", Namespace: "default"}.resolve(10 * time.Minute)
+	require.NoError(t, err)
+	return &rollupInfo{Target: target, Period: 600}, a
+}
+
+func TestBulkWriterRequestError(t *testing.T) {
+	f := &fakeBulk{status: []int{http.StatusBadRequest}}
+	w := newTestBulkWriter(t, f)
+	info, a := testRollup(t, 3)
+	logger := log.New(io.Discard, "", 0)
+
+	require.Error(t, w.write(context.Background(), logger, info, a))
+	// a failed request only fails the rollups it held
+	require.NoError(t, w.write(context.Background(), logger, info, a))
+	require.NoError(t, w.close(context.Background()))
+	require.Contains(t, w.stats(), "3 docs indexed")
+}
+
+func TestBulkWriterRetry(t *testing.T) {
+	f := &fakeBulk{itemStatus: []int{http.StatusTooManyRequests, http.StatusCreated, http.StatusTooManyRequests}}
+	w := newTestBulkWriter(t, f)
+	info, a := testRollup(t, 3)
+
+	require.NoError(t, w.write(context.Background(), log.New(io.Discard, "", 0), info, a))
+	require.NoError(t, w.close(context.Background()))
+	require.Contains(t, w.stats(), "3 docs indexed, 0 already present, 0 failed, 2 retries")
+
+	// bytes sent are those of the compressed request bodies
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	require.Contains(t, w.stats(), fmt.Sprintf("%d bytes sent in %d bulk requests", f.received, f.requests))
+}
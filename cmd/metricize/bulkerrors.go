@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+)
+
+const (
+	// maxFailureSamples is the number of failing documents kept for each kind of failure.
+	maxFailureSamples = 3
+	// maxSampleLen truncates sample documents in the summary.
+	maxSampleLen = 512
+)
+
+type bulkFailureKey struct {
+	Type, Reason string
+}
+
+type bulkFailureGroup struct {
+	count   int
+	samples []string
+}
+
+// bulkFailures collects failed bulk items grouped by error type and reason.
+// It is safe for concurrent use.
+type bulkFailures struct {
+	mu     sync.Mutex
+	total  int
+	groups map[bulkFailureKey]*bulkFailureGroup
+}
+
+// isAlreadyExists reports whether res failed only because a document with the same ID exists.
+func isAlreadyExists(res esutil.BulkIndexerResponseItem) bool {
+	return res.Status == http.StatusConflict && res.Error.Type == "version_conflict_engine_exception"
+}
+
+// add records the failure of the bulk item for doc.
+func (f *bulkFailures) add(res esutil.BulkIndexerResponseItem, doc []byte) {
+	key := bulkFailureKey{Type: res.Error.Type, Reason: res.Error.Reason}
+	if key.Type == "" {
+		key.Type = http.StatusText(res.Status)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.groups == nil {
+		f.groups = make(map[bulkFailureKey]*bulkFailureGroup)
+	}
+	g, ok := f.groups[key]
+	if !ok {
+		g = &bulkFailureGroup{}
+		f.groups[key] = g
+	}
+	g.count++
+	f.total++
+	if len(g.samples) < maxFailureSamples {
+		sample := strings.TrimSpace(string(doc))
+		if len(sample) > maxSampleLen {
+			sample = sample[:maxSampleLen] + "..."
+		}
+		g.samples = append(g.samples, sample)
+	}
+}
+
+// len returns the number of failed items recorded.
+func (f *bulkFailures) len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.total
+}
+
+// summary describes the recorded failures, most frequent first, with sample documents.
+func (f *bulkFailures) summary() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]bulkFailureKey, 0, len(f.groups))
+	for key := range f.groups {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return f.groups[keys[i]].count > f.groups[keys[j]].count
+	})
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d bulk items failed", f.total)
+	for _, key := range keys {
+		g := f.groups[key]
+		fmt.Fprintf(&b, "\n  %d x %s: %s", g.count, key.Type, key.Reason)
+		for _, sample := range g.samples {
+			fmt.Fprintf(&b, "\n    sample: %s", sample)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	esv8 "github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+
+	"github.com/graphaelli/metricize"
+)
+
+const (
+	durationHistogramField = "transaction.duration.histogram"
+	durationSummaryField   = "transaction.duration.summary"
+)
+
+// rollupAggs groups transaction metrics in Elasticsearch using a composite aggregation over the
+// aggregation key fields, summing duration histograms per key, instead of fetching every document.
+func rollupAggs(ctx context.Context, es *esv8.Client, index string, start, end int64, opts scanOptions) (*metricize.Aggregator, error) {
+	// observer.version splits keys only when a bucket mixes versions, letting the aggregator notice
+	keyFields := append(metricize.KeyFields(), "observer.version")
+	sources := make([]map[string]interface{}, len(keyFields))
+	for i, field := range keyFields {
+		sources[i] = map[string]interface{}{
+			field: map[string]interface{}{
+				"terms": map[string]interface{}{
+					"field":          field,
+					"missing_bucket": true,
+				},
+			},
+		}
+	}
+	composite := map[string]interface{}{
+		"size":    opts.PageSize,
+		"sources": sources,
+	}
+	query := map[string]interface{}{
+		"filter": []map[string]interface{}{
+			{
+				"range": map[string]interface{}{
+					"@timestamp": map[string]interface{}{
+						"gte": start * 1000,
+						"lt":  end * 1000,
+					},
+				},
+			},
+			{
+				"term": map[string]interface{}{
+					"metricset.name": "transaction",
+				},
+			},
+		},
+	}
+	opts.Filter.apply(query)
+	q := map[string]interface{}{
+		"size":  0,
+		"query": map[string]interface{}{"bool": query},
+		"aggs": map[string]interface{}{
+			"keys": map[string]interface{}{
+				"composite": composite,
+				"aggs": map[string]interface{}{
+					"duration": map[string]interface{}{
+						// an interval of 1 merges identical histogram values, yielding the summed histogram
+						"histogram": map[string]interface{}{
+							"field":         durationHistogramField,
+							"interval":      1,
+							"min_doc_count": 1,
+						},
+					},
+					// doc_count sums _doc_count, the transactions of the documents rather than their number
+					"docs": map[string]interface{}{
+						"value_count": map[string]interface{}{"field": "@timestamp"},
+					},
+					"latest": map[string]interface{}{
+						"top_hits": map[string]interface{}{
+							"size":    1,
+							"sort":    []map[string]interface{}{{"@timestamp": "desc"}},
+							"_source": []string{"@timestamp", "observer.*"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// keys are aggregated once all are read, in the order of their latest source document, so that the observer
+	// of the latest prevails for keys split by observer.version
+	type keyDoc struct {
+		doc    metricize.MetricDoc
+		docs   int64
+		latest time.Time
+	}
+	var docs []keyDoc
+	for {
+		rsp, err := es.Search(
+			es.Search.WithContext(ctx),
+			es.Search.WithIndex(index),
+			es.Search.WithBody(esutil.NewJSONReader(q)),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("while searching with composite aggregation: %w", err)
+		}
+		if rsp.IsError() {
+			body, _ := io.ReadAll(rsp.Body)
+			rsp.Body.Close()
+			// every key contributes a bucket per distinct duration, which may exceed search.max_buckets: request
+			// fewer keys per page until it does not
+			if size := composite["size"].(int); bytes.Contains(body, []byte("too_many_buckets_exception")) && size > 1 {
+				composite["size"] = size / 2
+				continue
+			}
+			return nil, fmt.Errorf("while searching with composite aggregation: [%s] %s", rsp.Status(), body)
+		}
+		var result struct {
+			Aggregations struct {
+				Keys struct {
+					AfterKey map[string]interface{} `json:"after_key"`
+					Buckets  []struct {
+						Key      map[string]interface{} `json:"key"`
+						DocCount int64                  `json:"doc_count"`
+						Duration struct {
+							Buckets []struct {
+								Key      float64 `json:"key"`
+								DocCount int64   `json:"doc_count"`
+							} `json:"buckets"`
+						} `json:"duration"`
+						Docs struct {
+							Value int64 `json:"value"`
+						} `json:"docs"`
+						Latest struct {
+							Hits struct {
+								Hits []struct {
+									Source metricize.MetricDoc `json:"_source"`
+								} `json:"hits"`
+							} `json:"hits"`
+						} `json:"latest"`
+					} `json:"buckets"`
+				} `json:"keys"`
+			} `json:"aggregations"`
+		}
+		err = json.NewDecoder(rsp.Body).Decode(&result)
+		rsp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("while decoding composite aggregation: %w", err)
+		}
+
+		for _, b := range result.Aggregations.Keys.Buckets {
+			if root, ok := b.Key["transaction.root"].(float64); ok {
+				// boolean terms may be keyed numerically
+				b.Key["transaction.root"] = root != 0
+			}
+			doc, err := metricize.MetricDocFromFields(b.Key)
+			if err != nil {
+				return nil, fmt.Errorf("while converting composite key %v: %w", b.Key, err)
+			}
+			doc.Timestamp = time.Unix(start, 0)
+			doc.DocCount = b.DocCount
+			var latest time.Time
+			if hits := b.Latest.Hits.Hits; len(hits) > 0 {
+				latest = hits[0].Source.Timestamp
+				doc.Observer = hits[0].Source.Observer
+			}
+			for _, hb := range b.Duration.Buckets {
+				doc.DurationHistogram.Values = append(doc.DurationHistogram.Values, int64(hb.Key))
+				doc.DurationHistogram.Counts = append(doc.DurationHistogram.Counts, hb.DocCount)
+			}
+			docs = append(docs, keyDoc{doc: doc, docs: b.Docs.Value, latest: latest})
+		}
+
+		if len(result.Aggregations.Keys.Buckets) == 0 || result.Aggregations.Keys.AfterKey == nil {
+			break
+		}
+		composite["after"] = result.Aggregations.Keys.AfterKey
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool { return docs[i].latest.Before(docs[j].latest) })
+	a := metricize.NewAggregator(time.Unix(start, 0))
+	for i := range docs {
+		if err := a.AggregateGroup(&docs[i].doc, docs[i].docs); err != nil {
+			return nil, fmt.Errorf("while aggregating %+v: %w", docs[i].doc, err)
+		}
+	}
+	return a, nil
+}
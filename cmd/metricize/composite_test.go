@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	esv8 "github.com/elastic/go-elasticsearch/v8"
+	"github.com/stretchr/testify/require"
+
+	"github.com/graphaelli/metricize"
+)
+
+// newFakeES returns a client of a server answering every request with handler, as Elasticsearch would.
+func newFakeES(tb testing.TB, handler http.HandlerFunc) *esv8.Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		handler(w, r)
+	}))
+	tb.Cleanup(srv.Close)
+	es, err := esv8.NewClient(esv8.Config{Addresses: []string{srv.URL}})
+	require.NoError(tb, err)
+	return es
+}
+
+// fakeSource answers the searches of both modes over docs: the PIT scan of docs mode, paged by hit position,
+// and the composite aggregation of aggs mode, paged by bucket position.
+type fakeSource struct {
+	docs     []metricize.MetricDoc
+	pageSize int
+	// hits and buckets are the pages of the responses, pre-encoded
+	hits, buckets [][]byte
+}
+
+func newFakeSource(tb testing.TB, docs []metricize.MetricDoc, pageSize int) *fakeSource {
+	f := &fakeSource{docs: docs, pageSize: pageSize}
+	for from := 0; from < len(docs); from += pageSize {
+		to := from + pageSize
+		if to > len(docs) {
+			to = len(docs)
+		}
+		var hits []map[string]interface{}
+		for i := from; i < to; i++ {
+			hits = append(hits, map[string]interface{}{"_source": docs[i], "sort": []int{i}})
+		}
+		b, err := json.Marshal(map[string]interface{}{
+			"pit_id": "pit",
+			"hits":   map[string]interface{}{"hits": hits},
+		})
+		require.NoError(tb, err)
+		f.hits = append(f.hits, b)
+	}
+
+	// group as the composite aggregation does, by key fields and observer.version
+	fields := append(metricize.KeyFields(), "observer.version")
+	type group struct {
+		key      map[string]interface{}
+		docCount int64
+		docs     int64
+		counts   map[int64]int64
+		latest   *metricize.MetricDoc
+	}
+	groups := make(map[string]*group)
+	var keys []string
+	for i := range docs {
+		key, err := docs[i].Fields(fields...)
+		require.NoError(tb, err)
+		id, err := json.Marshal(key)
+		require.NoError(tb, err)
+		g, ok := groups[string(id)]
+		if !ok {
+			g = &group{key: key, counts: make(map[int64]int64)}
+			groups[string(id)] = g
+			keys = append(keys, string(id))
+		}
+		// doc_count honors _doc_count, as in Elasticsearch
+		if docs[i].DocCount > 0 {
+			g.docCount += docs[i].DocCount
+		} else {
+			g.docCount++
+		}
+		g.docs++
+		for j, v := range docs[i].DurationHistogram.Values {
+			g.counts[v] += docs[i].DurationHistogram.Counts[j]
+		}
+		if g.latest == nil || docs[i].Timestamp.After(g.latest.Timestamp) {
+			g.latest = &docs[i]
+		}
+	}
+	sort.Strings(keys)
+	for from := 0; from < len(keys); from += pageSize {
+		to := from + pageSize
+		if to > len(keys) {
+			to = len(keys)
+		}
+		var buckets []map[string]interface{}
+		for _, id := range keys[from:to] {
+			g := groups[id]
+			var histogram []map[string]interface{}
+			for v, c := range g.counts {
+				histogram = append(histogram, map[string]interface{}{"key": float64(v), "doc_count": c})
+			}
+			buckets = append(buckets, map[string]interface{}{
+				"key":       g.key,
+				"doc_count": g.docCount,
+				"duration":  map[string]interface{}{"buckets": histogram},
+				"docs":      map[string]interface{}{"value": g.docs},
+				"latest": map[string]interface{}{"hits": map[string]interface{}{"hits": []map[string]interface{}{{
+					"_source": map[string]interface{}{"@timestamp": g.latest.Timestamp, "observer": g.latest.Observer},
+				}}}},
+			})
+		}
+		b, err := json.Marshal(map[string]interface{}{
+			"aggregations": map[string]interface{}{"keys": map[string]interface{}{
+				"after_key": map[string]interface{}{"page": len(f.buckets) + 1},
+				"buckets":   buckets,
+			}},
+		})
+		require.NoError(tb, err)
+		f.buckets = append(f.buckets, b)
+	}
+	return f
+}
+
+func (f *fakeSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/_pit") && r.Method == http.MethodPost:
+		fmt.Fprint(w, `{"id":"pit"}`)
+	case r.URL.Path == "/_pit":
+		fmt.Fprint(w, `{"succeeded":true}`)
+	case r.URL.Path == "/_search":
+		var q struct {
+			SearchAfter []int `json:"search_after"`
+		}
+		json.NewDecoder(r.Body).Decode(&q)
+		page := 0
+		if len(q.SearchAfter) > 0 {
+			page = (q.SearchAfter[0] + 1) / f.pageSize
+		}
+		if page >= len(f.hits) {
+			fmt.Fprint(w, `{"pit_id":"pit","hits":{"hits":[]}}`)
+			return
+		}
+		w.Write(f.hits[page])
+	case strings.HasSuffix(r.URL.Path, "/_search"):
+		var q struct {
+			Aggs struct {
+				Keys struct {
+					Composite struct {
+						After struct {
+							Page int `json:"page"`
+						} `json:"after"`
+					} `json:"composite"`
+				} `json:"keys"`
+			} `json:"aggs"`
+		}
+		json.NewDecoder(r.Body).Decode(&q)
+		if page := q.Aggs.Keys.Composite.After.Page; page < len(f.buckets) {
+			w.Write(f.buckets[page])
+			return
+		}
+		fmt.Fprint(w, `{"aggregations":{"keys":{"buckets":[]}}}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"error":"unexpected %s %s"}`, r.Method, r.URL.Path)
+	}
+}
+
+// sourceDocs returns n transaction metrics spread evenly over keys services within the 10 minutes from start.
+func sourceDocs(start time.Time, n, keys int) []metricize.MetricDoc {
+	docs := make([]metricize.MetricDoc, n)
+	for i := range docs {
+		doc := &docs[i]
+		doc.Timestamp = start.Add(time.Duration(i) * 10 * time.Minute / time.Duration(n)).UTC()
+		doc.Agent.Name = "go"
+		doc.Metricset.Name = "transaction"
+		doc.Service.Name = fmt.Sprintf("service-%d", i%keys)
+		doc.Transaction.Name = "GET /"
+		doc.Transaction.Type = "request"
+		doc.Observer.Version = "8.5.0"
+		doc.DurationHistogram = metricize.DurationHistogram{
+			Values: []int64{int64(1000 * (i%50 + 1)), 100000},
+			Counts: []int64{int64(i%3 + 1), 1},
+		}
+		// the number of transactions summarized, as apm-server sets it
+		doc.DocCount = int64(i%3 + 2)
+	}
+	return docs
+}
+
+// rollupsOf returns the rollup documents of a, ordered by service name.
+func rollupsOf(a *metricize.Aggregator) []metricize.MetricDoc {
+	var docs []metricize.MetricDoc
+	for key := range a.Buckets {
+		docs = append(docs, a.Emit(key))
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Service.Name < docs[j].Service.Name })
+	return docs
+}
+
+func TestReadBucketModes(t *testing.T) {
+	start := time.Unix(1670000400, 0)
+	src := newFakeSource(t, sourceDocs(start, 300, 7), 50)
+	es := newFakeES(t, src.ServeHTTP)
+
+	docs, err := readBucket(context.Background(), es, "metrics-apm*", start.Unix(), start.Unix()+600,
+		scanOptions{Mode: modeDocs, PageSize: 50, Slices: 1})
+	require.NoError(t, err)
+	aggs, err := readBucket(context.Background(), es, "metrics-apm*", start.Unix(), start.Unix()+600,
+		scanOptions{Mode: modeAggs, PageSize: 50})
+	require.NoError(t, err)
+
+	require.Len(t, docs.Buckets, 7)
+	require.EqualValues(t, 300, docs.Docs())
+	require.Equal(t, docs.Docs(), aggs.Docs())
+	require.EqualValues(t, 900, docs.Transactions())
+	require.Equal(t, docs.Transactions(), aggs.Transactions())
+	require.Equal(t, rollupsOf(docs), rollupsOf(aggs))
+}
+
+func TestReadBucketMixedVersions(t *testing.T) {
+	start := time.Unix(1670000400, 0)
+	source := sourceDocs(start, 300, 7)
+	// an upgrade halfway through, to a version sorting before the previous one in the composite aggregation
+	for i := range source {
+		if i < len(source)/2 {
+			source[i].Observer.Version = "8.9.0"
+		} else {
+			source[i].Observer.Version = "8.10.0"
+		}
+	}
+	src := newFakeSource(t, source, 50)
+	es := newFakeES(t, src.ServeHTTP)
+
+	docs, err := readBucket(context.Background(), es, "metrics-apm*", start.Unix(), start.Unix()+600,
+		scanOptions{Mode: modeDocs, PageSize: 50, Slices: 1})
+	require.NoError(t, err)
+	aggs, err := readBucket(context.Background(), es, "metrics-apm*", start.Unix(), start.Unix()+600,
+		scanOptions{Mode: modeAggs, PageSize: 50})
+	require.NoError(t, err)
+
+	require.Len(t, aggs.Buckets, 7)
+	require.Equal(t, []string{"8.10.0", "8.9.0"}, aggs.ObserverVersions())
+	require.Equal(t, docs.ObserverVersions(), aggs.ObserverVersions())
+	require.Equal(t, rollupsOf(docs), rollupsOf(aggs))
+	for _, rollup := range rollupsOf(aggs) {
+		require.Equal(t, start, rollup.Timestamp)
+		require.Equal(t, "8.10.0", rollup.Observer.Version)
+	}
+}
+
+func TestReadBucketTooManyBuckets(t *testing.T) {
+	start := time.Unix(1670000400, 0)
+	// pages of at most 25 keys fit within search.max_buckets
+	src := newFakeSource(t, sourceDocs(start, 300, 70), 25)
+	var sizes []int
+	es := newFakeES(t, func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		var q struct {
+			Aggs struct {
+				Keys struct {
+					Composite struct {
+						Size int `json:"size"`
+					} `json:"composite"`
+				} `json:"keys"`
+			} `json:"aggs"`
+		}
+		require.NoError(t, json.Unmarshal(body, &q))
+		sizes = append(sizes, q.Aggs.Keys.Composite.Size)
+		if q.Aggs.Keys.Composite.Size > 25 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":{"root_cause":[{"type":"too_many_buckets_exception"}],"type":"search_phase_execution_exception"},"status":400}`)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		src.ServeHTTP(w, r)
+	})
+
+	a, err := readBucket(context.Background(), es, "metrics-apm*", start.Unix(), start.Unix()+600,
+		scanOptions{Mode: modeAggs, PageSize: 100})
+	require.NoError(t, err)
+	require.Len(t, a.Buckets, 70)
+	require.EqualValues(t, 300, a.Docs())
+	// halved until accepted, then kept for the following pages
+	require.Equal(t, []int{100, 50, 25, 25, 25, 25}, sizes)
+}
+
+func TestReadBucketSearchError(t *testing.T) {
+	start := time.Unix(1670000400, 0)
+	es := newFakeES(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":{"type":"parsing_exception"},"status":400}`)
+	})
+	_, err := readBucket(context.Background(), es, "metrics-apm*", start.Unix(), start.Unix()+600,
+		scanOptions{Mode: modeAggs, PageSize: 100})
+	require.ErrorContains(t, err, "parsing_exception")
+}
+
+// BenchmarkReadBucket compares reading a bucket of source documents in docs and aggs mode, client side only: the
+// cost of Elasticsearch grouping the documents in aggs mode, and of transferring them in docs mode, is not measured.
+func BenchmarkReadBucket(b *testing.B) {
+	start := time.Unix(1670000400, 0)
+	for _, size := range []struct{ docs, keys int }{{10000, 10}, {10000, 1000}} {
+		src := newFakeSource(b, sourceDocs(start, size.docs, size.keys), 1000)
+		es := newFakeES(b, src.ServeHTTP)
+		for _, mode := range []string{modeDocs, modeAggs} {
+			b.Run(fmt.Sprintf("%s/docs=%d/keys=%d", mode, size.docs, size.keys), func(b *testing.B) {
+				opts := scanOptions{Mode: mode, PageSize: 1000, Slices: 1}
+				for i := 0; i < b.N; i++ {
+					if _, err := readBucket(context.Background(), es, "metrics-apm*", start.Unix(), start.Unix()+600, opts); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
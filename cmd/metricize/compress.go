@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// multiCloser closes each of its closers in order, returning the first error.
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var err error
+	for _, c := range m {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// openInput opens path, or stdin for "-", transparently decompressing gzip and zstd content
+// detected by its magic bytes.
+func openInput(path string) (io.Reader, io.Closer, error) {
+	var f io.ReadCloser = os.Stdin
+	if path != "-" {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return nil, nil, err
+		}
+	}
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return zr, multiCloser{zr, f}, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return zr, multiCloser{zr.IOReadCloser(), f}, nil
+	}
+	return br, f, nil
+}
+
+// createOutput creates path, or uses stdout for "-", compressing with gzip or zstd when
+// the file extension is .gz or .zst.
+func createOutput(path string) (io.Writer, io.Closer, error) {
+	if path == "-" {
+		return os.Stdout, multiCloser(nil), nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz", ".gzip":
+		zw := gzip.NewWriter(f)
+		return zw, multiCloser{zw, f}, nil
+	case ".zst", ".zstd":
+		zw, err := zstd.NewWriter(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return zw, multiCloser{zw, f}, nil
+	}
+	return f, f, nil
+}
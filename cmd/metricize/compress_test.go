@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeOutput writes content to path with createOutput.
+func writeOutput(t *testing.T, path, content string) {
+	w, c, err := createOutput(path)
+	require.NoError(t, err)
+	_, err = io.WriteString(w, content)
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+}
+
+// readInput returns what openInput reads from path.
+func readInput(t *testing.T, path string) string {
+	r, c, err := openInput(path)
+	require.NoError(t, err)
+	defer c.Close()
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	content := strings.Repeat(`{"metricset":{"name":"transaction"}}`+"\n", 100)
+	for ext, magic := range map[string][]byte{
+		".ndjson":  nil,
+		".gz":      gzipMagic,
+		".GZIP":    gzipMagic,
+		".zst":     zstdMagic,
+		".zstd":    zstdMagic,
+		".json.gz": gzipMagic,
+	} {
+		path := filepath.Join(t.TempDir(), "metrics"+ext)
+		writeOutput(t, path, content)
+
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		if magic == nil {
+			require.Equal(t, content, string(b), ext)
+		} else {
+			require.True(t, bytes.HasPrefix(b, magic), ext)
+			require.Less(t, len(b), len(content), ext)
+		}
+		require.Equal(t, content, readInput(t, path), ext)
+	}
+}
+
+func TestOpenInputDetectsContent(t *testing.T) {
+	content := `{"metricset":{"name":"transaction"}}` + "\n"
+	dir := t.TempDir()
+	// compressed files named otherwise are read by their content rather than their extension
+	for _, names := range [][2]string{
+		{"metrics.gz", "metrics.ndjson"},
+		{"metrics.zst", "metrics.gz"},
+		{"metrics.ndjson", "metrics.zst"},
+	} {
+		written, renamed := filepath.Join(dir, names[0]), filepath.Join(dir, "renamed-"+names[1])
+		writeOutput(t, written, content)
+		require.NoError(t, os.Rename(written, renamed))
+		require.Equal(t, content, readInput(t, renamed), names)
+	}
+}
+
+func TestOpenInputShort(t *testing.T) {
+	// shorter than the longest magic bytes
+	path := filepath.Join(t.TempDir(), "short")
+	require.NoError(t, os.WriteFile(path, []byte("{}"), 0o600))
+	require.Equal(t, "{}", readInput(t, path))
+}
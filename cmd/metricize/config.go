@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/graphaelli/metricize"
+)
+
+// duration is a time.Duration represented as a string such as "10m" in config files.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10m\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// config holds every setting of the rollup and serve commands.
+// Values are read from an optional JSON config file, with flags taking precedence.
+type config struct {
+	// File is the config file the settings were loaded from, if any.
+	File string `json:"-"`
+
+	Start           string   `json:"start,omitempty"`
+	End             string   `json:"end,omitempty"`
+	Interval        duration `json:"interval"`
+	Index           string   `json:"index"`
+	Workers         int      `json:"workers"`
+	ContinueOnError bool     `json:"continue_on_error"`
+	// DryRun reads and aggregates without writing anything, reporting what would have been written.
+	DryRun bool `json:"dry_run"`
+
+	// Input is an NDJSON file of source metrics rolled up instead of reading from Elasticsearch, - for stdin.
+	Input       string `json:"input,omitempty"`
+	InputFormat string `json:"input_format"`
+	// Output is the file rollups are written to as NDJSON instead of Elasticsearch, - for stdout.
+	// Rollups of Input are written to stdout when empty.
+	Output       string `json:"output,omitempty"`
+	OutputFormat string `json:"output_format"`
+	// Percentiles are the duration percentiles of CSV and Parquet output.
+	Percentiles []float64 `json:"percentiles,omitempty"`
+
+	// Filters select the source documents read from Elasticsearch.
+	Filters filterConfig `json:"filters"`
+
+	Mode     string `json:"mode"`
+	PageSize int    `json:"page_size"`
+	Slices   int    `json:"slices"`
+
+	Retry struct {
+		MaxRetries int      `json:"max_retries"`
+		Backoff    duration `json:"backoff"`
+		MaxBackoff duration `json:"max_backoff"`
+	} `json:"retry"`
+
+	Bulk struct {
+		FlushBytes       int      `json:"flush_bytes"`
+		FlushInterval    duration `json:"flush_interval"`
+		Workers          int      `json:"workers"`
+		DeterministicIDs bool     `json:"deterministic_ids"`
+		Compress         bool     `json:"compress"`
+	} `json:"bulk"`
+
+	OpenMetrics struct {
+		// Buckets are the histogram bucket upper bounds in seconds.
+		Buckets []float64 `json:"buckets,omitempty"`
+		// Addr is the address /metrics is served on, keeping metricize running to roll up new buckets as they complete.
+		Addr string `json:"addr,omitempty"`
+	} `json:"openmetrics"`
+
+	OTLP otlpConfig `json:"otlp"`
+
+	Serve struct {
+		// Addr is the address the bulk endpoint of the serve command listens on.
+		Addr string `json:"addr"`
+		// Grace is how long after an interval ends documents for it are still accepted before it is rolled up.
+		Grace duration `json:"grace"`
+	} `json:"serve"`
+
+	// Observer overrides the observer fields carried over from the source documents.
+	Observer metricize.Observer `json:"observer"`
+
+	Target   targetConfig   `json:"target"`
+	Template templateConfig `json:"template"`
+
+	Source      esFlags `json:"source"`
+	Destination esFlags `json:"destination"`
+}
+
+// registerFlags binds every setting of c to a flag in fs, populating c with the defaults.
+func (c *config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.File, "config", "", "JSON config file, flags take precedence over its values and ${VAR} or ${VAR:-default} in strings is replaced from the environment")
+	fs.StringVar(&c.Start, "start", "", "start time, now: "+time.Now().UTC().Format(time.RFC3339))
+	fs.StringVar(&c.End, "end", "", "end time, now: "+time.Now().UTC().Format(time.RFC3339))
+	c.Interval = duration(10 * time.Minute)
+	fs.Var(durationFlag{&c.Interval}, "i", "rollup interval size, defaults to 10m (for 10 minutes)")
+	fs.StringVar(&c.Index, "index", "metrics-apm*", "Elasticsearch Index")
+	fs.Var(stringsFlag{&c.Filters.Include}, "filter", "only roll up source documents where field:value, such as service.environment:production, repeat for more fields or alternative values of the same field")
+	fs.Var(stringsFlag{&c.Filters.Exclude}, "exclude", "skip source documents where field:value, such as service.name:canary, may be repeated")
+	fs.StringVar(&c.Filters.QueryFile, "query-file", "", "JSON file holding a query DSL clause source documents must also match")
+	fs.StringVar(&c.Input, "input", "", "NDJSON file of source metrics, search hits or search responses to roll up instead of reading from Elasticsearch, - for stdin, optionally gzip or zstd compressed")
+	fs.StringVar(&c.InputFormat, "input-format", inputNDJSON, "format of -input: ndjson for documents, search hits, search responses or OTLP/JSON metrics requests, otlp-proto for length prefixed OTLP protobuf metrics requests, of which only delta temporality histograms are read")
+	fs.StringVar(&c.Output, "output", "", "file rollups are written to as NDJSON instead of indexing them into Elasticsearch, - for stdout, which is the default with -input, compressed when ending in .gz or .zst")
+	fs.StringVar(&c.OutputFormat, "output-format", outputDocs, "format of -output: docs for one rollup document per line, bulk for an Elasticsearch bulk request body, openmetrics for OpenMetrics histograms, otlp-json or otlp-proto for OTLP metrics, csv or parquet for a row per rollup with duration percentiles")
+	fs.Var(floatsFlag{&c.Percentiles}, "percentiles", "comma separated duration percentiles of csv and parquet output, defaults to 50,90,95,99")
+	fs.StringVar(&c.OTLP.Histogram, "otlp-histogram", otlpExplicit, "histogram type of OTLP output: explicit for explicit bucket histograms, exponential for exponential histograms")
+	fs.Var(floatsFlag{&c.OTLP.Buckets}, "otlp-buckets", "comma separated explicit histogram bucket upper bounds in seconds for OTLP output")
+	fs.StringVar(&c.OTLP.Endpoint, "otlp-endpoint", "", "push rollups as OTLP metrics to this OTLP/HTTP endpoint, such as http://localhost:4318, instead of indexing them into Elasticsearch")
+	fs.StringVar(&c.OTLP.Headers, "otlp-headers", "", "comma separated key=value headers sent to the OTLP endpoint")
+	fs.Var(floatsFlag{&c.OpenMetrics.Buckets}, "openmetrics-buckets", "comma separated histogram bucket upper bounds in seconds for OpenMetrics output")
+	fs.StringVar(&c.OpenMetrics.Addr, "metrics-addr", "", "serve the rollups as OpenMetrics histograms accumulating every bucket on this address's /metrics, rolling up new buckets as they complete rather than exiting")
+	fs.StringVar(&c.Serve.Addr, "serve-addr", "localhost:9200", "address the serve command accepts Elasticsearch bulk requests on")
+	c.Serve.Grace = duration(30 * time.Second)
+	fs.Var(durationFlag{&c.Serve.Grace}, "serve-grace", "how long the serve command accepts documents for an interval after it ends, before rolling it up")
+	c.Source.register(fs, "source", "es-", "ELASTICSEARCH_")
+	fs.BoolVar(&c.Source.Insecure, "k", false, "InsecureSkipVerify, shorthand for -es-insecure")
+	c.Destination.register(fs, "destination", "dest-es-", "DEST_ELASTICSEARCH_")
+	fs.IntVar(&c.Workers, "workers", 1, "number of buckets to process concurrently")
+	fs.BoolVar(&c.ContinueOnError, "continue-on-error", false, "keep processing remaining buckets when one fails")
+	fs.BoolVar(&c.DryRun, "dry-run", false, "read and aggregate without installing templates, creating data streams or writing rollups, printing what each bucket would write")
+	fs.IntVar(&c.PageSize, "page-size", 100, "number of source documents, or composite keys in aggs mode, fetched per search request, aggs mode halving it while pages exceed search.max_buckets")
+	fs.IntVar(&c.Slices, "slices", 1, "number of PIT slices to scan concurrently for each bucket, docs mode only")
+	fs.IntVar(&c.Retry.MaxRetries, "max-retries", 3, "number of times transient Elasticsearch failures and rejected bulk items are retried, 0 to disable")
+	c.Retry.Backoff = duration(500 * time.Millisecond)
+	fs.Var(durationFlag{&c.Retry.Backoff}, "retry-backoff", "initial delay between retries, doubled on each attempt and jittered")
+	c.Retry.MaxBackoff = duration(30 * time.Second)
+	fs.Var(durationFlag{&c.Retry.MaxBackoff}, "retry-max-backoff", "maximum delay between retries")
+	fs.IntVar(&c.Bulk.FlushBytes, "bulk-flush-bytes", 512*1024, "bulk request body size that triggers a flush")
+	c.Bulk.FlushInterval = duration(200 * time.Millisecond)
+	fs.Var(durationFlag{&c.Bulk.FlushInterval}, "bulk-flush-interval", "maximum time documents are buffered before a bulk request is sent, each bucket waits up to this long for its last documents to be indexed")
+	fs.IntVar(&c.Bulk.Workers, "bulk-workers", 2, "number of concurrent bulk requests")
+	fs.BoolVar(&c.Bulk.Compress, "bulk-compress", true, "gzip bulk request bodies sent to Elasticsearch")
+	fs.BoolVar(&c.Bulk.DeterministicIDs, "deterministic-ids", false, "derive rollup document IDs from their dimensions and interval, treating already existing documents as written")
+	fs.StringVar(&c.Observer.Version, "observer-version", "", "set observer.version on rollups rather than taking it from the source documents")
+	fs.StringVar(&c.Observer.Hostname, "observer-hostname", "", "set observer.hostname on rollups rather than taking it from the source documents")
+	fs.StringVar(&c.Observer.Type, "observer-type", "", "set observer.type on rollups rather than taking it from the source documents")
+	fs.StringVar(&c.Target.Type, "target-type", "metrics", "type of the target data stream")
+	fs.StringVar(&c.Target.Dataset, "target-dataset", "apm.internal", "dataset of the target data stream, {{.Interval}} is replaced by the rollup interval such as 10m and {{.Duration}} by the interval such as 10m0s")
+	fs.StringVar(&c.Target.Namespace, "target-namespace", "rollup{{.Duration}}", "namespace of the target data stream, with the same replacements as -target-dataset, defaults to the data stream rollups have always been written to, such as metrics-apm.internal-rollup10m0s")
+	fs.StringVar(&c.Template.Setup, "template", templateVerify, "index template handling for the target data stream: install to install a template and lifecycle policy, verify to warn when the existing mappings would not map rollups correctly, skip to do neither")
+	fs.BoolVar(&c.Template.TSDS, "template-tsds", false, "install the template in time series mode, rollups older than the data stream's look back time are rejected")
+	fs.StringVar(&c.Template.ILMPolicy, "ilm-policy", "metricize-rollup", "name of the lifecycle policy installed when a retention is set")
+	fs.StringVar(&c.Template.Retention, "retention", "", "delete rollups after this long, such as 90d, keeps them forever when empty")
+	fs.StringVar(&c.Template.RolloverMaxAge, "ilm-rollover-max-age", "30d", "age at which the lifecycle policy rolls rollup indices over")
+	fs.StringVar(&c.Template.RolloverMaxPrimaryShardSize, "ilm-rollover-max-primary-shard-size", "50gb", "primary shard size at which the lifecycle policy rolls rollup indices over")
+	fs.StringVar(&c.Mode, "mode", modeDocs, "how source metrics are read: docs to aggregate every document client side, aggs to group with a composite aggregation in Elasticsearch")
+	//pitKeepAlive := flag.String("keep-alive", "5m", "PIT keep alive duration")
+}
+
+// openMetricsExporter returns the exporter configured by c.
+func (c *config) openMetricsExporter() metricize.OpenMetricsExporter {
+	return metricize.OpenMetricsExporter{Buckets: c.OpenMetrics.Buckets}
+}
+
+// durationFlag adapts a duration to flag.Value.
+type durationFlag struct {
+	d *duration
+}
+
+func (f durationFlag) String() string {
+	if f.d == nil {
+		return ""
+	}
+	return time.Duration(*f.d).String()
+}
+
+func (f durationFlag) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*f.d = duration(v)
+	return nil
+}
+
+// parseConfig parses args into a config, loading the config file named by -config if any.
+func parseConfig(fs *flag.FlagSet, args []string) (*config, error) {
+	var c config
+	c.registerFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if c.File == "" {
+		c.credentialsFromEnv()
+		return &c, nil
+	}
+	if err := c.load(c.File); err != nil {
+		return nil, fmt.Errorf("while loading %s: %w", c.File, err)
+	}
+	// apply the flags again so they take precedence over the file, lists given on the command line replacing
+	// those of the file rather than adding to them
+	fs.Visit(func(f *flag.Flag) {
+		if l, ok := f.Value.(stringsFlag); ok {
+			*l.s = nil
+		}
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	c.credentialsFromEnv()
+	return &c, nil
+}
+
+// credentialsFromEnv sets the credentials of both clusters neither flags nor the config file provided from the
+// environment.
+func (c *config) credentialsFromEnv() {
+	c.Source.credentialsFromEnv()
+	c.Destination.credentialsFromEnv()
+}
+
+// load overrides c with the settings present in the JSON file at path.
+func (c *config) load(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var raw interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if b, err = json.Marshal(expandEnv(raw)); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(c)
+}
+
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces ${VAR} and ${VAR:-default} references in every string of the decoded JSON value v.
+func expandEnv(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return envVarPattern.ReplaceAllStringFunc(v, func(ref string) string {
+			m := envVarPattern.FindStringSubmatch(ref)
+			if value, ok := os.LookupEnv(m[1]); ok && (value != "" || m[2] == "") {
+				return value
+			}
+			return m[3]
+		})
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = expandEnv(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = expandEnv(child)
+		}
+	}
+	return v
+}
+
+// validate reports the first invalid setting in c.
+func (c *config) validate() error {
+	if c.Interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+	if c.Serve.Grace < 0 {
+		return errors.New("serve grace must not be negative")
+	}
+	for _, t := range []string{c.Start, c.End} {
+		if t == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, t); err != nil {
+			return err
+		}
+	}
+	if c.Mode != modeDocs && c.Mode != modeAggs {
+		return fmt.Errorf("unknown mode %q, must be %q or %q", c.Mode, modeDocs, modeAggs)
+	}
+	if c.Mode == modeAggs && c.Slices > 1 {
+		return errors.New("slices only apply to docs mode, aggs mode pages through composite buckets instead")
+	}
+	switch c.OutputFormat {
+	case outputDocs, outputBulk, outputOpenMetrics, outputOTLPJSON, outputOTLPProto, outputCSV, outputParquet:
+	default:
+		return fmt.Errorf("unknown output format %q, must be one of %q, %q, %q, %q, %q, %q or %q",
+			c.OutputFormat, outputDocs, outputBulk, outputOpenMetrics, outputOTLPJSON, outputOTLPProto, outputCSV, outputParquet)
+	}
+	for _, p := range c.Percentiles {
+		if p <= 0 || p > 100 {
+			return fmt.Errorf("invalid percentile %g, must be in (0, 100]", p)
+		}
+	}
+	if c.InputFormat != inputNDJSON && c.InputFormat != inputOTLPProto {
+		return fmt.Errorf("unknown input format %q, must be %q or %q", c.InputFormat, inputNDJSON, inputOTLPProto)
+	}
+	if !sort.Float64sAreSorted(c.OpenMetrics.Buckets) || !sort.Float64sAreSorted(c.OTLP.Buckets) {
+		return errors.New("histogram buckets must be in increasing order")
+	}
+	if err := c.OTLP.validate(); err != nil {
+		return err
+	}
+	if _, err := c.Filters.query(); err != nil {
+		return err
+	}
+	if c.Filters.isSet() && c.Input != "" {
+		return errors.New("filters only apply when reading from Elasticsearch")
+	}
+	if c.OpenMetrics.Addr != "" && c.Input != "" {
+		return errors.New("metrics can only be served when reading from Elasticsearch")
+	}
+	if _, err := c.Target.resolve(time.Duration(c.Interval)); err != nil {
+		return fmt.Errorf("invalid target: %w", err)
+	}
+	if err := c.Template.validate(); err != nil {
+		return err
+	}
+	if c.Template.TSDS && c.Bulk.DeterministicIDs {
+		return errors.New("time series data streams do not support deterministic IDs")
+	}
+	if c.PageSize < 1 {
+		return errors.New("page size must be at least 1")
+	}
+	if _, err := c.Source.config(); err != nil {
+		return fmt.Errorf("invalid source cluster settings: %w", err)
+	}
+	if _, err := c.Destination.config(); err != nil {
+		return fmt.Errorf("invalid destination cluster settings: %w", err)
+	}
+	return nil
+}
+
+// redacted returns a copy of c with credentials masked, suitable for printing.
+func (c config) redacted() config {
+	for _, es := range []*esFlags{&c.Source, &c.Destination} {
+		for _, secret := range []*string{&es.Password, &es.APIKey, &es.ServiceToken} {
+			if *secret != "" {
+				*secret = "REDACTED"
+			}
+		}
+	}
+	return c
+}
+
+// configCheck implements the "config check" subcommand, validating and printing the effective config.
+func configCheck(args []string) error {
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	c, err := parseConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c.redacted())
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfigListFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"filters": {"include": ["service.name:a"], "exclude": ["service.name:b"]}}`), 0o600))
+
+	c, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{
+		"-config", path, "-filter", "service.name:c", "-filter", "service.name:d",
+	})
+	require.NoError(t, err)
+	// lists of the command line replace those of the file, others are kept
+	require.Equal(t, []string{"service.name:c", "service.name:d"}, c.Filters.Include)
+	require.Equal(t, []string{"service.name:b"}, c.Filters.Exclude)
+}
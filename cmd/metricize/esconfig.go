@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	esv8 "github.com/elastic/go-elasticsearch/v8"
+)
+
+// esFlags holds the settings for connecting to an Elasticsearch cluster.
+type esFlags struct {
+	Addresses    string `json:"addresses,omitempty"`
+	CloudID      string `json:"cloud_id,omitempty"`
+	Username     string `json:"username,omitempty"`
+	Password     string `json:"password,omitempty"`
+	APIKey       string `json:"api_key,omitempty"`
+	ServiceToken string `json:"service_token,omitempty"`
+	// CACert, ClientCert and ClientKey are paths to PEM encoded files.
+	CACert     string `json:"ca_cert,omitempty"`
+	ClientCert string `json:"client_cert,omitempty"`
+	ClientKey  string `json:"client_key,omitempty"`
+	Insecure   bool   `json:"insecure,omitempty"`
+	// Timeout limits how long to wait for the response headers of each request, 0 for no limit.
+	// Searches of large buckets, composite aggregations especially, can take minutes before responding.
+	Timeout duration `json:"timeout,omitempty"`
+
+	// envPrefix is the prefix of the environment variables the credentials are read from when not set.
+	envPrefix string
+}
+
+// register adds the connection flags for the named cluster to fs, each prefixed by flagPrefix,
+// defaulting to the corresponding environment variables prefixed by envPrefix. Credentials are left
+// empty, rather than shown as defaults in the usage output, until credentialsFromEnv.
+func (c *esFlags) register(fs *flag.FlagSet, name, flagPrefix, envPrefix string) {
+	c.envPrefix = envPrefix
+	env := func(v string) string {
+		return os.Getenv(envPrefix + v)
+	}
+	fs.StringVar(&c.Addresses, flagPrefix+"addresses", env("URL"), fmt.Sprintf("comma separated %s Elasticsearch URLs, defaults to $%sURL", name, envPrefix))
+	fs.StringVar(&c.CloudID, flagPrefix+"cloud-id", env("CLOUD_ID"), fmt.Sprintf("%s Elastic Cloud ID, defaults to $%sCLOUD_ID", name, envPrefix))
+	fs.StringVar(&c.Username, flagPrefix+"username", env("USERNAME"), fmt.Sprintf("%s username for basic authentication, defaults to $%sUSERNAME", name, envPrefix))
+	fs.StringVar(&c.Password, flagPrefix+"password", "", fmt.Sprintf("%s password for basic authentication, defaults to $%sPASSWORD", name, envPrefix))
+	fs.StringVar(&c.APIKey, flagPrefix+"api-key", "", fmt.Sprintf("%s base64 encoded API key, defaults to $%sAPI_KEY", name, envPrefix))
+	fs.StringVar(&c.ServiceToken, flagPrefix+"service-token", "", fmt.Sprintf("%s service account token, defaults to $%sSERVICE_TOKEN", name, envPrefix))
+	fs.StringVar(&c.CACert, flagPrefix+"ca-cert", env("CA_CERT"), fmt.Sprintf("path to a PEM encoded CA certificate to trust for the %s cluster, defaults to $%sCA_CERT", name, envPrefix))
+	fs.StringVar(&c.ClientCert, flagPrefix+"client-cert", env("CLIENT_CERT"), fmt.Sprintf("path to a PEM encoded %s client certificate, defaults to $%sCLIENT_CERT", name, envPrefix))
+	fs.StringVar(&c.ClientKey, flagPrefix+"client-key", env("CLIENT_KEY"), fmt.Sprintf("path to the PEM encoded %s client certificate key, defaults to $%sCLIENT_KEY", name, envPrefix))
+	fs.BoolVar(&c.Insecure, flagPrefix+"insecure", false, fmt.Sprintf("skip verifying the %s cluster's TLS certificate", name))
+	fs.Var(durationFlag{&c.Timeout}, flagPrefix+"timeout", fmt.Sprintf("how long to wait for the %s cluster to start responding to each request, such as 5m, unlimited by default as searches of large buckets can take minutes", name))
+}
+
+// credentialsFromEnv sets the credentials not provided otherwise from the environment variables.
+func (c *esFlags) credentialsFromEnv() {
+	for v, s := range map[string]*string{
+		"PASSWORD":      &c.Password,
+		"API_KEY":       &c.APIKey,
+		"SERVICE_TOKEN": &c.ServiceToken,
+	} {
+		if *s == "" {
+			*s = os.Getenv(c.envPrefix + v)
+		}
+	}
+}
+
+// isSet reports whether any setting was provided.
+func (c *esFlags) isSet() bool {
+	return c.connects() || c.Timeout != 0
+}
+
+// connects reports whether any connection setting, other than the timeout, was provided.
+func (c *esFlags) connects() bool {
+	return c.Addresses != "" || c.CloudID != "" || c.Username != "" || c.Password != "" || c.APIKey != "" ||
+		c.ServiceToken != "" || c.CACert != "" || c.ClientCert != "" || c.ClientKey != "" || c.Insecure
+}
+
+// orFallback returns c, or the connection settings of fallback with the timeout of c if c has none of its own.
+func (c *esFlags) orFallback(fallback *esFlags) *esFlags {
+	if c.connects() {
+		return c
+	}
+	f := *fallback
+	if c.Timeout != 0 {
+		f.Timeout = c.Timeout
+	}
+	return &f
+}
+
+// config returns the client configuration described by c.
+func (c *esFlags) config() (esv8.Config, error) {
+	var cfg esv8.Config
+	if c.Addresses != "" {
+		for _, addr := range strings.Split(c.Addresses, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				cfg.Addresses = append(cfg.Addresses, addr)
+			}
+		}
+	}
+	cfg.CloudID = c.CloudID
+	cfg.Username = c.Username
+	cfg.Password = c.Password
+	cfg.APIKey = c.APIKey
+	cfg.ServiceToken = c.ServiceToken
+
+	// configure a transport of our own rather than mutating http.DefaultTransport
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Duration(c.Timeout)
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.Insecure,
+	}
+	if c.CACert != "" {
+		pem, err := os.ReadFile(c.CACert)
+		if err != nil {
+			return cfg, fmt.Errorf("while reading CA certificate: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return cfg, fmt.Errorf("no certificates found in %s", c.CACert)
+		}
+	}
+	if c.ClientCert != "" || c.ClientKey != "" {
+		if c.ClientCert == "" || c.ClientKey == "" {
+			return cfg, errors.New("both a client certificate and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return cfg, fmt.Errorf("while loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	cfg.Transport = transport
+	return cfg, nil
+}
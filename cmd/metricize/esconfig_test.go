@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestESFlagsOrFallback(t *testing.T) {
+	var c config
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.registerFlags(fs)
+	require.NoError(t, fs.Parse([]string{"-es-addresses", "https://source:9200", "-dest-es-timeout", "10m"}))
+
+	// only a timeout still counts as destination settings, connecting to the source cluster
+	require.True(t, c.Destination.isSet())
+	dest := c.Destination.orFallback(&c.Source)
+	require.Equal(t, "https://source:9200", dest.Addresses)
+	require.Equal(t, duration(10*time.Minute), dest.Timeout)
+	require.Zero(t, c.Source.Timeout)
+
+	c.Destination.Addresses = "https://dest:9200"
+	require.Same(t, &c.Destination, c.Destination.orFallback(&c.Source))
+}
+
+func TestESFlagsCredentialsFromEnv(t *testing.T) {
+	t.Setenv("ELASTICSEARCH_PASSWORD", "source-password")
+	t.Setenv("ELASTICSEARCH_API_KEY", "source-api-key")
+	t.Setenv("DEST_ELASTICSEARCH_SERVICE_TOKEN", "dest-service-token")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var usage strings.Builder
+	fs.SetOutput(&usage)
+	c, err := parseConfig(fs, []string{"-es-api-key", "flag-api-key"})
+	require.NoError(t, err)
+	require.Equal(t, "source-password", c.Source.Password)
+	require.Equal(t, "flag-api-key", c.Source.APIKey)
+	require.Equal(t, "dest-service-token", c.Destination.ServiceToken)
+
+	// the usage output names the variables without disclosing their values
+	fs.PrintDefaults()
+	require.Contains(t, usage.String(), "$ELASTICSEARCH_PASSWORD")
+	for _, secret := range []string{"source-password", "source-api-key", "dest-service-token"} {
+		require.NotContains(t, usage.String(), secret)
+	}
+}
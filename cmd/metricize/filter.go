@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// filterConfig selects the source documents rolled up, on top of the time range and metricset.name.
+type filterConfig struct {
+	// Include are field:value pairs source documents must match. Values of the same field are alternatives.
+	Include []string `json:"include,omitempty"`
+	// Exclude are field:value pairs source documents must not match.
+	Exclude []string `json:"exclude,omitempty"`
+	// QueryFile is a JSON file holding a query DSL clause source documents must match too.
+	QueryFile string `json:"query_file,omitempty"`
+}
+
+func (c *filterConfig) isSet() bool {
+	return len(c.Include) > 0 || len(c.Exclude) > 0 || c.QueryFile != ""
+}
+
+// sourceFilter holds the query clauses selecting source documents, added to the bool query of every search.
+type sourceFilter struct {
+	Filter  []map[string]interface{}
+	MustNot []map[string]interface{}
+}
+
+// query returns the clauses selected by c, reading the query file if any.
+func (c *filterConfig) query() (sourceFilter, error) {
+	var f sourceFilter
+	include, err := termsClauses(c.Include)
+	if err != nil {
+		return f, err
+	}
+	exclude, err := termsClauses(c.Exclude)
+	if err != nil {
+		return f, err
+	}
+	f.Filter, f.MustNot = include, exclude
+	if c.QueryFile == "" {
+		return f, nil
+	}
+	b, err := os.ReadFile(c.QueryFile)
+	if err != nil {
+		return f, err
+	}
+	var q map[string]interface{}
+	if err := json.Unmarshal(b, &q); err != nil {
+		return f, fmt.Errorf("while parsing %s: %w", c.QueryFile, err)
+	}
+	// accept a whole search body as well as a bare clause
+	if inner, ok := q["query"].(map[string]interface{}); ok && len(q) == 1 {
+		q = inner
+	}
+	if len(q) != 1 {
+		return f, fmt.Errorf("%s must hold a single query clause, such as {\"bool\": {...}}", c.QueryFile)
+	}
+	f.Filter = append(f.Filter, q)
+	return f, nil
+}
+
+// termsClauses converts field:value pairs into a terms clause per field, in field order.
+func termsClauses(pairs []string) ([]map[string]interface{}, error) {
+	values := make(map[string][]string)
+	var fields []string
+	for _, pair := range pairs {
+		field, value, ok := strings.Cut(pair, ":")
+		field, value = strings.TrimSpace(field), strings.TrimSpace(value)
+		if !ok || field == "" {
+			return nil, fmt.Errorf("invalid filter %q, must be field:value", pair)
+		}
+		if _, ok := values[field]; !ok {
+			fields = append(fields, field)
+		}
+		values[field] = append(values[field], value)
+	}
+	sort.Strings(fields)
+	clauses := make([]map[string]interface{}, len(fields))
+	for i, field := range fields {
+		clauses[i] = map[string]interface{}{
+			"terms": map[string]interface{}{field: values[field]},
+		}
+	}
+	return clauses, nil
+}
+
+// apply adds the clauses of f to the bool query b.
+func (f sourceFilter) apply(b map[string]interface{}) {
+	if len(f.Filter) > 0 {
+		filter, _ := b["filter"].([]map[string]interface{})
+		b["filter"] = append(filter, f.Filter...)
+	}
+	if len(f.MustNot) > 0 {
+		mustNot, _ := b["must_not"].([]map[string]interface{})
+		b["must_not"] = append(mustNot, f.MustNot...)
+	}
+}
+
+// stringsFlag is a flag that may be repeated, collecting every value.
+type stringsFlag struct {
+	s *[]string
+}
+
+func (f stringsFlag) String() string {
+	if f.s == nil {
+		return ""
+	}
+	return strings.Join(*f.s, ", ")
+}
+
+func (f stringsFlag) Set(s string) error {
+	*f.s = append(*f.s, s)
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTermsClausesMalformed(t *testing.T) {
+	for _, pair := range []string{"", "service.name", ":production", " : production", "service.name=production"} {
+		_, err := termsClauses([]string{"service.name:ok", pair})
+		require.Error(t, err, "%q", pair)
+		require.Contains(t, err.Error(), "must be field:value", "%q", pair)
+	}
+}
+
+func TestTermsClauses(t *testing.T) {
+	for name, tc := range map[string]struct {
+		pairs []string
+		want  []map[string]interface{}
+	}{
+		"none": {
+			want: []map[string]interface{}{},
+		},
+		"trimmed": {
+			pairs: []string{" service.name : checkout "},
+			want:  []map[string]interface{}{{"terms": map[string]interface{}{"service.name": []string{"checkout"}}}},
+		},
+		// only the first colon separates the field from the value
+		"colon in value": {
+			pairs: []string{"url.full:http://localhost:8080"},
+			want:  []map[string]interface{}{{"terms": map[string]interface{}{"url.full": []string{"http://localhost:8080"}}}},
+		},
+		// values of the same field are alternatives of a single clause, fields in order
+		"repeated field": {
+			pairs: []string{"service.name:a", "service.environment:prod", "service.name:b"},
+			want: []map[string]interface{}{
+				{"terms": map[string]interface{}{"service.environment": []string{"prod"}}},
+				{"terms": map[string]interface{}{"service.name": []string{"a", "b"}}},
+			},
+		},
+	} {
+		clauses, err := termsClauses(tc.pairs)
+		require.NoError(t, err, name)
+		require.Equal(t, tc.want, clauses, name)
+	}
+}
+
+func TestFilterConfigQueryFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+	clause := map[string]interface{}{"bool": map[string]interface{}{"should": []interface{}{}}}
+
+	// a bare clause, or a whole search body, follows the include clauses
+	for _, content := range []string{`{"bool": {"should": []}}`, `{"query": {"bool": {"should": []}}}`} {
+		c := filterConfig{Include: []string{"service.name:a"}, Exclude: []string{"service.name:b"}, QueryFile: write("query.json", content)}
+		f, err := c.query()
+		require.NoError(t, err, content)
+		require.Equal(t, []map[string]interface{}{
+			{"terms": map[string]interface{}{"service.name": []string{"a"}}},
+			clause,
+		}, f.Filter, content)
+		require.Equal(t, []map[string]interface{}{
+			{"terms": map[string]interface{}{"service.name": []string{"b"}}},
+		}, f.MustNot, content)
+	}
+
+	for content, msg := range map[string]string{
+		`{"bool": `:                 "while parsing",
+		`[]`:                        "while parsing",
+		`{}`:                        "single query clause",
+		`{"term": {}, "range": {}}`: "single query clause",
+		`{"query": {}, "size": 0}`:  "single query clause",
+	} {
+		c := filterConfig{QueryFile: write("invalid.json", content)}
+		_, err := c.query()
+		require.Error(t, err, content)
+		require.Contains(t, err.Error(), msg, content)
+	}
+
+	_, err := (&filterConfig{QueryFile: filepath.Join(dir, "missing.json")}).query()
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// searchBodies records the bodies of the searches answered by handler.
+type searchBodies struct {
+	mu      sync.Mutex
+	handler http.HandlerFunc
+	bodies  [][]byte
+}
+
+func (s *searchBodies) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/_search") {
+		b, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.bodies = append(s.bodies, b)
+		s.mu.Unlock()
+		r.Body = io.NopCloser(bytes.NewReader(b))
+	}
+	s.handler(w, r)
+}
+
+// boolQuery returns the filter and must_not clauses of the bool query of a search body, as decoded JSON.
+func boolQuery(t *testing.T, body []byte) (filter, mustNot []interface{}) {
+	var q struct {
+		Query struct {
+			Bool struct {
+				Filter  []interface{} `json:"filter"`
+				MustNot []interface{} `json:"must_not"`
+			} `json:"bool"`
+		} `json:"query"`
+	}
+	require.NoError(t, json.Unmarshal(body, &q))
+	return q.Query.Bool.Filter, q.Query.Bool.MustNot
+}
+
+// jsonValue returns v as decoded from its JSON encoding.
+func jsonValue(t *testing.T, v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	var decoded interface{}
+	require.NoError(t, json.Unmarshal(b, &decoded))
+	return decoded
+}
+
+func TestSourceFilterApply(t *testing.T) {
+	filter := sourceFilter{
+		Filter:  []map[string]interface{}{{"terms": map[string]interface{}{"service.environment": []string{"prod"}}}},
+		MustNot: []map[string]interface{}{{"terms": map[string]interface{}{"service.name": []string{"canary"}}}},
+	}
+	start := time.Unix(1670000400, 0)
+	timeRange := map[string]interface{}{"range": map[string]interface{}{"@timestamp": map[string]interface{}{
+		"gte": start.UnixMilli(),
+		"lt":  start.Add(10 * time.Minute).UnixMilli(),
+	}}}
+	metricset := map[string]interface{}{"term": map[string]interface{}{"metricset.name": "transaction"}}
+
+	for _, mode := range []string{modeDocs, modeAggs} {
+		src := newFakeSource(t, sourceDocs(start, 10, 2), 5)
+		searches := &searchBodies{handler: src.ServeHTTP}
+		es := newFakeES(t, searches.ServeHTTP)
+		_, err := readBucket(context.Background(), es, "metrics-apm*", start.Unix(), start.Unix()+600,
+			scanOptions{Mode: mode, PageSize: 5, Slices: 1, Filter: filter})
+		require.NoError(t, err, mode)
+
+		// every page searches the time range and metricset, narrowed by the filter
+		require.NotEmpty(t, searches.bodies, mode)
+		for _, body := range searches.bodies {
+			filterClauses, mustNotClauses := boolQuery(t, body)
+			require.Equal(t, jsonValue(t, []interface{}{timeRange, metricset, filter.Filter[0]}), filterClauses, mode)
+			require.Equal(t, jsonValue(t, filter.MustNot), mustNotClauses, mode)
+		}
+	}
+}
+
+func TestSourceFilterApplyAppends(t *testing.T) {
+	existing := map[string]interface{}{"term": map[string]interface{}{"metricset.name": "transaction"}}
+	b := map[string]interface{}{
+		"filter":   []map[string]interface{}{existing},
+		"must_not": []map[string]interface{}{existing},
+	}
+	clause := map[string]interface{}{"exists": map[string]interface{}{"field": "service.name"}}
+	sourceFilter{Filter: []map[string]interface{}{clause}, MustNot: []map[string]interface{}{clause}}.apply(b)
+	require.Equal(t, []map[string]interface{}{existing, clause}, b["filter"])
+	require.Equal(t, []map[string]interface{}{existing, clause}, b["must_not"])
+
+	// an empty filter leaves the query as it is
+	empty := map[string]interface{}{}
+	sourceFilter{}.apply(empty)
+	require.Empty(t, empty)
+}
+
+func TestMinTimeFilter(t *testing.T) {
+	searches := &searchBodies{handler: func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"hits":{"total":{"value":3}},"aggregations":{"start":{"value":1670000400000,"value_as_string":"2022-12-02T17:00:00.000Z"}}}`)
+	}}
+	es := newFakeES(t, searches.ServeHTTP)
+
+	// without a filter, every document is considered
+	mt, err := minTime(context.Background(), es, "metrics-apm*", sourceFilter{})
+	require.NoError(t, err)
+	require.Equal(t, 1670000400000.0, mt)
+	var q map[string]interface{}
+	require.NoError(t, json.Unmarshal(searches.bodies[0], &q))
+	require.NotContains(t, q, "query")
+
+	// with one, the earliest selected document is
+	filter := sourceFilter{
+		Filter:  []map[string]interface{}{{"terms": map[string]interface{}{"service.environment": []string{"prod"}}}},
+		MustNot: []map[string]interface{}{{"terms": map[string]interface{}{"service.name": []string{"canary"}}}},
+	}
+	_, err = minTime(context.Background(), es, "metrics-apm*", filter)
+	require.NoError(t, err)
+	filterClauses, mustNotClauses := boolQuery(t, searches.bodies[1])
+	require.Equal(t, jsonValue(t, filter.Filter), filterClauses)
+	require.Equal(t, jsonValue(t, filter.MustNot), mustNotClauses)
+}
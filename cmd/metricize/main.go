@@ -3,7 +3,8 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -13,31 +14,41 @@ import (
 	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"text/template"
 	"time"
 
 	esv8 "github.com/elastic/go-elasticsearch/v8"
-	"github.com/elastic/go-elasticsearch/v8/esapi"
 	"github.com/elastic/go-elasticsearch/v8/esutil"
 
 	"github.com/graphaelli/metricize"
 )
 
-func minTime(ctx context.Context, es *esv8.Client, index string) (float64, error) {
-	q := `{
-  "size": 0,
-  "aggs": {
-    "start": {
-      "min": {
-        "field": "@timestamp"
-      }
-    }
-  }
-}`
+// minTime returns the earliest timestamp in index, in milliseconds, of the documents selected by filter.
+func minTime(ctx context.Context, es *esv8.Client, index string, filter sourceFilter) (float64, error) {
+	q := map[string]interface{}{
+		"size": 0,
+		"aggs": map[string]interface{}{
+			"start": map[string]interface{}{
+				"min": map[string]interface{}{
+					"field": "@timestamp",
+				},
+			},
+		},
+	}
+	if len(filter.Filter) > 0 || len(filter.MustNot) > 0 {
+		query := make(map[string]interface{})
+		filter.apply(query)
+		q["query"] = map[string]interface{}{"bool": query}
+	}
 	rsp, err := es.Search(
 		es.Search.WithContext(ctx),
-		es.Search.WithBody(strings.NewReader(q)),
+		es.Search.WithBody(esutil.NewJSONReader(q)),
 		es.Search.WithIndex(index),
 		es.Search.WithTrackTotalHits(true),
 	)
@@ -108,6 +119,8 @@ func rollupExists(ctx context.Context, es *esv8.Client, index string, interval,
 		es.Search.WithBody(&body),
 		es.Search.WithIndex(index),
 		es.Search.WithTrackTotalHits(false),
+		es.Search.WithIgnoreUnavailable(true),
+		es.Search.WithAllowNoIndices(true),
 	)
 	if err != nil {
 		return true, err
@@ -127,9 +140,51 @@ func rollupExists(ctx context.Context, es *esv8.Client, index string, interval,
 	return len(result.Hits.Hits) > 0, nil
 }
 
-func rollup(ctx context.Context, es *esv8.Client, index string, start, end int64) (*metricize.Aggregator, error) {
-	pitKeepAlive := "5m"
+const (
+	// modeDocs fetches every source document and aggregates client side.
+	modeDocs = "docs"
+	// modeAggs groups source documents in Elasticsearch with a composite aggregation.
+	modeAggs = "aggs"
+)
+
+// scanOptions controls how source documents are read for each bucket.
+type scanOptions struct {
+	// Mode is one of modeDocs or modeAggs.
+	Mode string
+	// PageSize is the number of hits, or composite buckets, requested per search page.
+	PageSize int
+	// Slices is the number of PIT slices scanned concurrently, 1 disables slicing.
+	Slices int
+	// Filter selects the source documents beyond the time range and metricset.name.
+	Filter sourceFilter
+}
+
+type pitQuery struct {
+	Size  int `json:"size"`
+	Query struct {
+		Bool struct {
+			Filter  []map[string]interface{} `json:"filter"`
+			MustNot []map[string]interface{} `json:"must_not,omitempty"`
+		} `json:"bool"`
+	} `json:"query"`
+	Source      []string                 `json:"_source,omitempty"`
+	PIT         map[string]interface{}   `json:"pit,omitempty"`
+	Slice       map[string]interface{}   `json:"slice,omitempty"`
+	SearchAfter []interface{}            `json:"search_after,omitempty"`
+	Sort        []map[string]interface{} `json:"sort"`
+}
+
+const pitKeepAlive = "5m"
+
+// readBucket aggregates the source documents of index between start and end, in seconds, as opts.Mode says.
+func readBucket(ctx context.Context, es *esv8.Client, index string, start, end int64, opts scanOptions) (*metricize.Aggregator, error) {
+	if opts.Mode == modeAggs {
+		return rollupAggs(ctx, es, index, start, end, opts)
+	}
+	return rollup(ctx, es, index, start, end, opts)
+}
 
+func rollup(ctx context.Context, es *esv8.Client, index string, start, end int64, opts scanOptions) (*metricize.Aggregator, error) {
 	rsp, err := es.OpenPointInTime(
 		strings.Split(index, ","),
 		pitKeepAlive,
@@ -155,18 +210,7 @@ func rollup(ctx context.Context, es *esv8.Client, index string, start, end int64
 		}
 	}()
 
-	q := struct {
-		Size  int `json:"size"`
-		Query struct {
-			Bool struct {
-				Filter []map[string]interface{} `json:"filter"`
-			} `json:"bool"`
-		} `json:"query"`
-		PIT         map[string]interface{}   `json:"pit,omitempty"`
-		SearchAfter []interface{}            `json:"search_after,omitempty"`
-		Sort        []map[string]interface{} `json:"sort"`
-	}{}
-
+	var q pitQuery
 	q.Query.Bool.Filter = []map[string]interface{}{
 		{
 			"range": map[string]interface{}{
@@ -182,8 +226,12 @@ func rollup(ctx context.Context, es *esv8.Client, index string, start, end int64
 			},
 		},
 	}
+	q.Query.Bool.Filter = append(q.Query.Bool.Filter, opts.Filter.Filter...)
+	q.Query.Bool.MustNot = opts.Filter.MustNot
 
-	q.Size = 100
+	q.Size = opts.PageSize
+	// only fetch what the aggregation needs
+	q.Source = metricize.SourceFields()
 	q.Sort = []map[string]interface{}{{
 		"@timestamp": map[string]interface{}{
 			"order": "asc",
@@ -194,91 +242,216 @@ func rollup(ctx context.Context, es *esv8.Client, index string, start, end int64
 		"keep_alive": pitKeepAlive,
 	}
 	a := metricize.NewAggregator(time.Unix(start, 0))
+	if opts.Slices <= 1 {
+		if err := scan(ctx, es, q, a); err != nil {
+			return nil, err
+		}
+		return a, nil
+	}
+
+	// each slice pages through its own share of the PIT, all feeding the same aggregator
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		sliceErr error
+	)
+	for i := 0; i < opts.Slices; i++ {
+		sq := q
+		sq.Slice = map[string]interface{}{
+			"id":  i,
+			"max": opts.Slices,
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := scan(ctx, es, sq, a); err != nil {
+				errOnce.Do(func() {
+					sliceErr = fmt.Errorf("while scanning slice %d: %w", i, err)
+					cancel()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+	if sliceErr != nil {
+		return nil, sliceErr
+	}
+	return a, nil
+}
+
+// scan pages through all hits matching q using search_after, aggregating each into a.
+func scan(ctx context.Context, es *esv8.Client, q pitQuery, a *metricize.Aggregator) error {
 	for {
 		body := esutil.NewJSONReader(q)
-		rsp, err = es.Search(
+		rsp, err := es.Search(
+			es.Search.WithContext(ctx),
 			es.Search.WithBody(body),
 		)
 		if err != nil {
-			return nil, fmt.Errorf("while searching with pagination query: %w", err)
+			return fmt.Errorf("while searching with pagination query: %w", err)
 		}
 		if rsp.IsError() {
-			return nil, fmt.Errorf("while searching with pagingation query: %s", rsp.String())
-		}
-
-		var result struct {
-			PITID string `json:"pit_id"`
-			Hits  struct {
-				Hits []struct {
-					Source metricize.MetricDoc `json:"_source"`
-					Sort   []interface{}       `json:"sort"`
-				} `json:"hits"`
-			} `json:"hits"`
-		}
-		defer rsp.Body.Close()
-		if err := json.NewDecoder(rsp.Body).Decode(&result); err != nil {
-			return nil, fmt.Errorf("while decoding pagination query: %w", err)
-		}
-		if len(result.Hits.Hits) == 0 {
-			break
+			return fmt.Errorf("while searching with pagingation query: %s", rsp.String())
 		}
 
 		var lastSort []interface{}
-		for _, d := range result.Hits.Hits {
-			if err := a.Aggregate(&d.Source); err != nil {
-				return nil, fmt.Errorf("while aggregating %+v: %w", d, err)
+		pitID, n, err := metricize.DecodeSearchHits(rsp.Body, func(hit *metricize.SearchHit) error {
+			if err := a.Aggregate(&hit.Source); err != nil {
+				return fmt.Errorf("while aggregating %+v: %w", hit, err)
 			}
-			lastSort = d.Sort
+			lastSort = append(lastSort[:0], hit.Sort...)
+			return nil
+		})
+		rsp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("while decoding pagination query: %w", err)
+		}
+		if n == 0 {
+			return nil
 		}
 
 		q.SearchAfter = lastSort
 		q.PIT = map[string]interface{}{
-			"id":         result.PITID,
+			"id":         pitID,
 			"keep_alive": pitKeepAlive,
 		}
 	}
-	return a, nil
+}
+
+// toolVersion returns the version of metricize, as recorded in the binary's build info.
+func toolVersion() string {
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		return bi.Main.Version
+	}
+	return "unknown"
+}
+
+// newRunID returns a random identifier for this invocation.
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// newClient creates a client for the cluster described by flags.
+func newClient(flags *esFlags, retry retryConfig, compress bool) (*esv8.Client, error) {
+	cfg, err := flags.config()
+	if err != nil {
+		return nil, err
+	}
+	retry.apply(&cfg)
+	cfg.CompressRequestBody = compress
+	return esv8.NewClient(cfg)
 }
 
 func main() {
 	log.Default().SetFlags(log.Ldate | log.Ltime | log.Llongfile)
-	start := flag.String("start", "", "start time, now: "+time.Now().UTC().Format(time.RFC3339))
-	end := flag.String("end", "", "end time, now: "+time.Now().UTC().Format(time.RFC3339))
-	interval := flag.Duration("i", 10*time.Minute, "rollup interval size, defaults to 10m (for 10 minutes)")
-	index := flag.String("index", "metrics-apm*", "Elasticsearch Index")
-	skipTLSVerify := flag.Bool("k", false, "InsecureSkipVerify")
-	//pitKeepAlive := flag.String("keep-alive", "5m", "PIT keep alive duration")
-	flag.Parse()
-
-	var esConfig esv8.Config
-	esConfig.APIKey = os.Getenv("ELASTICSEARCH_API_KEY")
-	esConfig.Transport = http.DefaultTransport
-	if *skipTLSVerify {
-		esConfig.Transport.(*http.Transport).TLSClientConfig = &tls.Config{
-			InsecureSkipVerify: true,
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "check" {
+		if err := configCheck(os.Args[3:]); err != nil {
+			log.Fatal(err)
 		}
+		return
+	}
+	args := os.Args[1:]
+	var serve bool
+	if len(args) > 0 && args[0] == "rollup" {
+		// rollup is the default command, accepted for clarity
+		args = args[1:]
+	} else if len(args) > 0 && args[0] == "serve" {
+		serve = true
+		args = args[1:]
+	}
+	cfg, err := parseConfig(flag.CommandLine, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		log.Fatal(err)
+	}
+	if serve {
+		if err := runServe(cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if cfg.Input != "" {
+		if err := runOffline(cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	run(cfg)
+}
+
+// run rolls up the source metrics described by cfg.
+func run(cfg *config) {
+	interval := time.Duration(cfg.Interval)
+	retry := retryConfig{
+		MaxRetries: cfg.Retry.MaxRetries,
+		Backoff:    time.Duration(cfg.Retry.Backoff),
+		MaxBackoff: time.Duration(cfg.Retry.MaxBackoff),
+	}
+
+	// raw metrics are read from the source cluster and rollups written to the destination,
+	// which is the same cluster unless any destination settings are provided
+	es, err := newClient(&cfg.Source, retry, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	destES := es
+	if cfg.Destination.isSet() {
+		destES, err = newClient(cfg.Destination.orFallback(&cfg.Source), retry, cfg.Bulk.Compress)
+	} else if cfg.Bulk.Compress {
+		// a client of its own so that only requests writing rollups are compressed
+		destES, err = newClient(&cfg.Source, retry, true)
 	}
-	es, err := esv8.NewClient(esConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 	ctx := context.Background()
 
-	targetIndex := "metrics-apm.internal-rollup" + interval.String()
-	if err := createIndex(ctx, es, targetIndex); err != nil {
+	target, err := cfg.Target.resolve(interval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	targetIndex := target.String()
+	filter, err := cfg.Filters.query()
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, err := openSink(ctx, cfg, destES, targetIndex, retry)
+	if err != nil {
 		log.Fatal(err)
 	}
+	if !cfg.DryRun && (cfg.Output != "" || cfg.OTLP.Endpoint != "") {
+		// nothing is written to Elasticsearch, so there are no existing rollups to skip either
+		destES = nil
+	}
+
+	if cfg.OpenMetrics.Addr != "" {
+		if out, err = serveMetrics(cfg.OpenMetrics.Addr, cfg.openMetricsExporter(), out); err != nil {
+			log.Fatal(err)
+		}
+		// keep running until interrupted, closing the sink on the way out
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+	}
 
 	// figure out what time to start
 	var startSec float64
-	if *start != "" {
-		t, err := time.Parse(time.RFC3339, *start)
+	if cfg.Start != "" {
+		t, err := time.Parse(time.RFC3339, cfg.Start)
 		if err != nil {
 			log.Fatal(err)
 		}
 		startSec = float64(t.Unix())
 	} else {
-		mt, err := minTime(ctx, es, *index)
+		mt, err := minTime(ctx, es, cfg.Index, filter)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -288,40 +461,125 @@ func main() {
 
 	// required end time
 	var endSec int64
-	if *end == "" {
+	if cfg.End == "" {
 		// stop 1 bucket before the one including the current time since the current bucket could still be written to
 		endSec = int64(
 			math.Floor(float64(time.Now().UTC().Unix())/interval.Seconds())*interval.Seconds() - interval.Seconds())
 	} else {
-		t, err := time.Parse(time.RFC3339, *end)
+		t, err := time.Parse(time.RFC3339, cfg.End)
 		if err != nil {
 			log.Fatal(err)
 		}
 		endSec = t.Unix()
 	}
 
-	bucket := int64(startBucket)
 	step := int64(interval.Seconds())
-	for ; bucket < endSec; bucket += step {
+	info := &rollupInfo{
+		Target: target,
+		Period: step,
+		Provenance: metricize.Provenance{
+			SourceIndex: cfg.Index,
+			Version:     toolVersion(),
+			RunID:       newRunID(),
+		},
+		Observer: cfg.Observer,
+	}
+	log.Printf("rolling up %s into %s, run ID %s", cfg.Index, targetIndex, info.Provenance.RunID)
+	var buckets []int64
+	for bucket := int64(startBucket); bucket < endSec; bucket += step {
+		buckets = append(buckets, bucket)
+	}
+	rollupBucket := func(ctx context.Context, logger *log.Logger, bucket int64) error {
 		// TODO: option to validate existing rollup
-		exists, err := rollupExists(ctx, es, *index, step, bucket)
-		if err != nil {
-			log.Fatal(fmt.Errorf("while checking if rollup exists for %s: %w",
-				time.Unix(bucket, 0).String(), err))
+		if destES != nil {
+			exists, err := rollupExists(ctx, destES, targetIndex, step, bucket)
+			if err != nil {
+				return fmt.Errorf("while checking if rollup exists: %w", err)
+			}
+			if exists {
+				logger.Printf("skippping existing rollup for %s", time.Unix(bucket, 0).String())
+				return nil
+			}
 		}
-		if exists {
-			log.Printf("skippping existing rollup for %s", time.Unix(bucket, 0).String())
-			continue
+		logger.Printf("rolling up %s", time.Unix(bucket, 0).String())
+		opts := scanOptions{
+			Mode:     cfg.Mode,
+			PageSize: cfg.PageSize,
+			Slices:   cfg.Slices,
+			Filter:   filter,
 		}
-		log.Printf("rolling up %s", time.Unix(bucket, 0).String())
-		a, err := rollup(ctx, es, *index, bucket, bucket+step)
+		began := time.Now()
+		a, err := readBucket(ctx, es, cfg.Index, bucket, bucket+step, opts)
 		if err != nil {
-			log.Fatal(fmt.Errorf("while rolling up %s: %w", time.Unix(bucket, 0).String(), err))
+			return fmt.Errorf("while rolling up: %w", err)
+		}
+		logger.Printf("read %d keys in %s using %s mode", len(a.Buckets), time.Since(began), opts.Mode)
+		if versions := a.ObserverVersions(); len(versions) > 1 {
+			logger.Printf("warning: bucket mixes data from observer versions %s", strings.Join(versions, ", "))
+		}
+		if err := out.write(ctx, logger, info, a); err != nil {
+			return fmt.Errorf("while writing rollup: %w", err)
+		}
+		return nil
+	}
+	err = processBuckets(ctx, buckets, cfg.Workers, cfg.ContinueOnError, rollupBucket)
+	if err == nil && cfg.OpenMetrics.Addr != "" {
+		log.Printf("following new buckets as they complete")
+		if err = followBuckets(ctx, endSec, step, cfg.ContinueOnError, rollupBucket); errors.Is(err, context.Canceled) {
+			err = nil
+		}
+		ctx = context.Background()
+	}
+	if closeErr := out.close(ctx); err == nil {
+		err = closeErr
+	}
+	log.Print(out.stats())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// openSink creates the sink rollups are written to: nothing for a dry run, cfg.Output, the OTLP endpoint or
+// otherwise the targetIndex data stream of destES, set up according to cfg.Template.
+func openSink(ctx context.Context, cfg *config, destES *esv8.Client, targetIndex string, retry retryConfig) (sink, error) {
+	switch {
+	case cfg.DryRun:
+		if cfg.Template.Setup == templateVerify {
+			if err := verifyTemplate(ctx, destES, targetIndex); err != nil {
+				log.Printf("warning: %s", err)
+			}
+		}
+		return &dryRunSink{}, nil
+	case cfg.Output != "":
+		return newFileSink(cfg, cfg.Output)
+	case cfg.OTLP.Endpoint != "":
+		return newOTLPHTTPSink(cfg.OTLP, retry)
+	}
+	bulk, err := newBulkWriter(destES, bulkConfig{
+		FlushBytes:       cfg.Bulk.FlushBytes,
+		FlushInterval:    time.Duration(cfg.Bulk.FlushInterval),
+		Workers:          cfg.Bulk.Workers,
+		DeterministicIDs: cfg.Bulk.DeterministicIDs,
+		Retry:            retry,
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Template.Setup {
+	case templateInstall:
+		if err := installTemplate(ctx, destES, cfg.Template, targetIndex); err != nil {
+			return nil, err
 		}
-		if err := emitRollup(ctx, es, targetIndex, step, a); err != nil {
-			log.Fatal(fmt.Errorf("while writing rollup for %s: %w", time.Unix(bucket, 0).String(), err))
+	case templateVerify:
+		// warn rather than fail, as with a dry run: mappings can be fixed without rolling up again
+		if err := verifyTemplate(ctx, destES, targetIndex); err != nil {
+			log.Printf("warning: %s", err)
 		}
 	}
+	if err := createIndex(ctx, destES, targetIndex); err != nil {
+		return nil, err
+	}
+	return bulk, nil
 }
 
 func createIndex(ctx context.Context, es *esv8.Client, targetIndex string) error {
@@ -354,61 +612,30 @@ func createIndex(ctx context.Context, es *esv8.Client, targetIndex string) error
 	return nil
 }
 
-// copied almost wholesale from https://github.com/axw/metricate/
-func emitRollup(ctx context.Context, es *esv8.Client, targetIndex string, period int64, a *metricize.Aggregator) error {
-	var buf bytes.Buffer
-	doBulkRequest := func() error {
-		if buf.Len() == 0 {
-			return nil
-		}
-		response, err := esapi.BulkRequest{
-			Index: targetIndex,
-			Body:  &buf,
-		}.Do(ctx, es)
-		if err != nil {
-			return err
-		}
-		defer response.Body.Close()
-		if response.IsError() {
-			io.Copy(os.Stderr, response.Body)
-			return errors.New("bulk indexing failed")
-		}
-		var result struct {
-			Errors bool            `json:"errors"`
-			Items  json.RawMessage `json:"items"`
-		}
-		if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
-			return fmt.Errorf("bulk indexing might have failed, eror parsing result: %w", err)
-		}
-		// why isn't this a non-200 and triggered by response.IsError() ?
-		if result.Errors {
-			return fmt.Errorf("bulk indexing failed with: %s", string(result.Items))
-		}
-		return nil
+// rollupInfo describes the rollup being written, recorded on every emitted document.
+type rollupInfo struct {
+	Target     metricize.DataStream
+	Period     int64
+	Provenance metricize.Provenance
+	// Observer holds the observer fields overriding those of the source documents, where set.
+	Observer metricize.Observer
+}
+
+// decorate marks doc as a rollup described by r.
+func (r *rollupInfo) decorate(doc *metricize.MetricDoc) {
+	target, provenance := r.Target, r.Provenance
+	doc.DataStream = &target
+	doc.Metricset.Name = "transaction_rollup"
+	doc.Metricset.Interval = metricize.FormatInterval(time.Duration(r.Period) * time.Second)
+	doc.NumericLabels.Period = r.Period
+	doc.Metricize = &provenance
+	if r.Observer.Hostname != "" {
+		doc.Observer.Hostname = r.Observer.Hostname
 	}
-	const limit = 512 * 1024 // 512KiB limit for bulk request body
-	var ndocs int
-	enc := json.NewEncoder(&buf)
-	for key := range a.Buckets {
-		doc := a.Emit(key)
-		doc.Metricset.Name = "transaction_rollup"
-		doc.NumericLabels.Period = period
-		doc.Observer.Version = "8.5.2"
-		fmt.Fprintf(&buf, `{"create": {}}`+"\n")
-		ndocs++
-		if err := enc.Encode(&doc); err != nil {
-			return err
-		}
-		if buf.Len() >= limit {
-			if err := doBulkRequest(); err != nil {
-				return err
-			}
-			buf.Reset()
-		}
+	if r.Observer.Type != "" {
+		doc.Observer.Type = r.Observer.Type
 	}
-	if err := doBulkRequest(); err != nil {
-		return err
+	if r.Observer.Version != "" {
+		doc.Observer.Version = r.Observer.Version
 	}
-	log.Printf("Indexed %d metrics docs into %s", ndocs, targetIndex)
-	return nil
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/graphaelli/metricize"
+)
+
+// runOffline rolls up the source metrics in cfg.Input, NDJSON or OTLP protobuf as set by cfg.InputFormat, writing the rollup documents as NDJSON to
+// cfg.Output, or stdout, without connecting to Elasticsearch.
+func runOffline(cfg *config) error {
+	interval := time.Duration(cfg.Interval)
+	target, err := cfg.Target.resolve(interval)
+	if err != nil {
+		return err
+	}
+	step := int64(interval.Seconds())
+	info := &rollupInfo{
+		Target: target,
+		Period: step,
+		Provenance: metricize.Provenance{
+			SourceIndex: cfg.Input,
+			Version:     toolVersion(),
+			RunID:       newRunID(),
+		},
+		Observer: cfg.Observer,
+	}
+	log.Printf("rolling up %s, run ID %s", cfg.Input, info.Provenance.RunID)
+
+	var start, end time.Time
+	if cfg.Start != "" {
+		if start, err = time.Parse(time.RFC3339, cfg.Start); err != nil {
+			return err
+		}
+	}
+	if cfg.End != "" {
+		if end, err = time.Parse(time.RFC3339, cfg.End); err != nil {
+			return err
+		}
+	}
+
+	in, closer, err := openInput(cfg.Input)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	aggregators := make(map[int64]*metricize.Aggregator)
+	var skipped int
+	decode := metricize.DecodeDocs
+	if cfg.InputFormat == inputOTLPProto {
+		decode = decodeOTLPProto
+	}
+	n, cumulative, err := decode(in, func(doc *metricize.MetricDoc) error {
+		if doc.Metricset.Name != "transaction" ||
+			(!start.IsZero() && doc.Timestamp.Before(start)) || (!end.IsZero() && !doc.Timestamp.Before(end)) {
+			skipped++
+			return nil
+		}
+		bucket := doc.Timestamp.Unix()
+		bucket -= bucket % step
+		if doc.Timestamp.Unix() < bucket {
+			bucket -= step
+		}
+		a, ok := aggregators[bucket]
+		if !ok {
+			a = metricize.NewAggregator(time.Unix(bucket, 0))
+			aggregators[bucket] = a
+		}
+		return a.Aggregate(doc)
+	})
+	if err != nil {
+		return fmt.Errorf("while reading %s: %w", cfg.Input, err)
+	}
+	log.Printf("read %d docs, skipped %d outside the time range or not transaction metrics", n, skipped)
+	if cumulative > 0 {
+		log.Printf("skipped %d cumulative OTLP data points, only delta temporality can be rolled up", cumulative)
+	}
+
+	buckets := make([]int64, 0, len(aggregators))
+	for bucket := range aggregators {
+		buckets = append(buckets, bucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+
+	output := cfg.Output
+	if output == "" {
+		output = "-"
+	}
+	var out sink = &dryRunSink{}
+	switch {
+	case cfg.DryRun:
+	case cfg.OTLP.Endpoint != "" && cfg.Output == "":
+		retry := retryConfig{
+			MaxRetries: cfg.Retry.MaxRetries,
+			Backoff:    time.Duration(cfg.Retry.Backoff),
+			MaxBackoff: time.Duration(cfg.Retry.MaxBackoff),
+		}
+		if out, err = newOTLPHTTPSink(cfg.OTLP, retry); err != nil {
+			return err
+		}
+	default:
+		if out, err = newFileSink(cfg, output); err != nil {
+			return err
+		}
+	}
+	ctx := context.Background()
+	for _, bucket := range buckets {
+		a := aggregators[bucket]
+		if versions := a.ObserverVersions(); len(versions) > 1 {
+			log.Printf("warning: bucket %s mixes data from observer versions %s",
+				time.Unix(bucket, 0).UTC().Format(time.RFC3339), strings.Join(versions, ", "))
+		}
+		if err := out.write(ctx, log.Default(), info, a); err != nil {
+			out.close(ctx)
+			return err
+		}
+	}
+	if err := out.close(ctx); err != nil {
+		return err
+	}
+	log.Print(out.stats())
+	return nil
+}
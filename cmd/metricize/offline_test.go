@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/graphaelli/metricize"
+)
+
+func TestRunOffline(t *testing.T) {
+	start := time.Unix(1670000400, 0).UTC()
+	// two intervals of 4 documents over 2 services, and documents to skip
+	docs := append(sourceDocs(start, 4, 2), sourceDocs(start.Add(10*time.Minute), 4, 2)...)
+	early := sourceDocs(start.Add(-10*time.Minute), 1, 1)[0]
+	other := sourceDocs(start, 1, 1)[0]
+	other.Metricset.Name = "service_destination"
+	docs = append(docs, early, other)
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "metrics.ndjson")
+	f, err := os.Create(input)
+	require.NoError(t, err)
+	enc := json.NewEncoder(f)
+	for _, doc := range docs {
+		require.NoError(t, enc.Encode(doc))
+	}
+	require.NoError(t, f.Close())
+
+	output := filepath.Join(dir, "rollups.ndjson")
+	cfg, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{
+		"-input", input, "-output", output, "-start", start.Format(time.RFC3339),
+	})
+	require.NoError(t, err)
+	require.NoError(t, cfg.validate())
+	captureLog(t)
+	require.NoError(t, runOffline(cfg))
+
+	f, err = os.Open(output)
+	require.NoError(t, err)
+	defer f.Close()
+	var rollups []metricize.MetricDoc
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var doc metricize.MetricDoc
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &doc))
+		rollups = append(rollups, doc)
+	}
+	require.NoError(t, scanner.Err())
+	sort.SliceStable(rollups, func(i, j int) bool { return rollups[i].Service.Name < rollups[j].Service.Name })
+	sort.SliceStable(rollups, func(i, j int) bool { return rollups[i].Timestamp.Before(rollups[j].Timestamp) })
+
+	require.Len(t, rollups, 4)
+	for i, rollup := range rollups {
+		bucket := start.Add(time.Duration(i/2) * 10 * time.Minute)
+		require.Equal(t, bucket, rollup.Timestamp.UTC(), i)
+		require.Equal(t, fmt.Sprintf("service-%d", i%2), rollup.Service.Name, i)
+		require.Equal(t, "transaction_rollup", rollup.Metricset.Name)
+		require.Equal(t, "10m", rollup.Metricset.Interval)
+		require.EqualValues(t, 600, rollup.NumericLabels.Period)
+		require.Equal(t, &metricize.DataStream{Type: "metrics", Dataset: "apm.internal", Namespace: "rollup10m0s"}, rollup.DataStream)
+		require.Equal(t, input, rollup.Metricize.SourceIndex)
+		require.Equal(t, "8.5.0", rollup.Observer.Version)
+	}
+
+	// each rollup holds the durations of its source documents
+	counts := make(map[string]int64)
+	for _, doc := range docs[:8] {
+		for _, c := range doc.DurationHistogram.Counts {
+			counts[doc.Timestamp.Truncate(10*time.Minute).String()+doc.Service.Name] += c
+		}
+	}
+	for i, rollup := range rollups {
+		var count int64
+		for _, c := range rollup.DurationHistogram.Counts {
+			count += c
+		}
+		want := counts[rollup.Timestamp.String()+rollup.Service.Name]
+		require.Equal(t, want, count, i)
+		require.Equal(t, want, rollup.DurationSummary.ValueCount, i)
+	}
+}
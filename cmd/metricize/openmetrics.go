@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/graphaelli/metricize"
+)
+
+// outputOpenMetrics writes an OpenMetrics text exposition of every rollup.
+const outputOpenMetrics = "openmetrics"
+
+// floatsFlag is a comma separated list of numbers.
+type floatsFlag struct {
+	f *[]float64
+}
+
+func (f floatsFlag) String() string {
+	if f.f == nil {
+		return ""
+	}
+	s := make([]string, len(*f.f))
+	for i, v := range *f.f {
+		s[i] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return strings.Join(s, ",")
+}
+
+func (f floatsFlag) Set(s string) error {
+	var values []float64
+	for _, part := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return err
+		}
+		values = append(values, v)
+	}
+	*f.f = values
+	return nil
+}
+
+// decoratedDocs returns the rollup documents of a, decorated by info.
+func decoratedDocs(info *rollupInfo, a *metricize.Aggregator) []metricize.MetricDoc {
+	docs := make([]metricize.MetricDoc, 0, len(a.Buckets))
+	for key := range a.Buckets {
+		doc := a.Emit(key)
+		info.decorate(&doc)
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+// metricsHandler passes rollups on to the next sink, serving the histograms of every one so far on /metrics.
+// Samples carry no timestamp: they are the totals at the time of the scrape, as counters are expected to be.
+type metricsHandler struct {
+	next     sink
+	exporter metricize.OpenMetricsExporter
+	srv      *http.Server
+	srvErr   chan error
+
+	mu sync.RWMutex
+	// total accumulates the rollups written, whatever the order their buckets complete in
+	total *metricize.Aggregator
+}
+
+func (h *metricsHandler) write(ctx context.Context, logger *log.Logger, info *rollupInfo, a *metricize.Aggregator) error {
+	if err := h.next.write(ctx, logger, info, a); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key := range a.Buckets {
+		doc := a.Emit(key)
+		if err := h.total.Aggregate(&doc); err != nil {
+			return fmt.Errorf("while accumulating metrics: %w", err)
+		}
+	}
+	return nil
+}
+
+// close stops serving metrics, then closes the next sink.
+func (h *metricsHandler) close(ctx context.Context) error {
+	err := h.srv.Shutdown(ctx)
+	if srvErr := <-h.srvErr; err == nil && !errors.Is(srvErr, http.ErrServerClosed) {
+		err = fmt.Errorf("while serving metrics: %w", srvErr)
+	}
+	if closeErr := h.next.close(ctx); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (h *metricsHandler) stats() string {
+	return h.next.stats()
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	docs := make([]metricize.MetricDoc, 0, len(h.total.Buckets))
+	for key := range h.total.Buckets {
+		docs = append(docs, h.total.Emit(key))
+	}
+	h.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	if err := h.exporter.Write(w, docs); err != nil {
+		log.Printf("while serving metrics: %s", err)
+	}
+}
+
+// serveMetrics serves the rollups written through next on addr, in the background until closed.
+func serveMetrics(addr string, exporter metricize.OpenMetricsExporter, next sink) (*metricsHandler, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("while serving metrics: %w", err)
+	}
+	h := &metricsHandler{
+		next:     next,
+		exporter: exporter,
+		srvErr:   make(chan error, 1),
+		total:    metricize.NewAggregator(time.Time{}),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", h)
+	h.srv = &http.Server{Addr: l.Addr().String(), Handler: mux}
+	go func() {
+		h.srvErr <- h.srv.Serve(l)
+	}()
+	log.Printf("serving rollups as OpenMetrics on http://%s/metrics", h.srv.Addr)
+	return h, nil
+}
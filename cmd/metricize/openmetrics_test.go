@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeMetrics(t *testing.T) {
+	h, err := serveMetrics("127.0.0.1:0", (&config{}).openMetricsExporter(), &dryRunSink{})
+	require.NoError(t, err)
+	info, a := testRollup(t, 3)
+	logger := log.New(io.Discard, "", 0)
+	// the same rollup twice, as two buckets would be
+	require.NoError(t, h.write(context.Background(), logger, info, a))
+	require.NoError(t, h.write(context.Background(), logger, info, a))
+
+	rsp, err := http.Get("http://" + h.srv.Addr + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	require.NoError(t, err)
+
+	var counts []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "transaction_duration_seconds_count{") {
+			counts = append(counts, line[strings.LastIndex(line, "}")+1:])
+		}
+	}
+	// totals across buckets, without timestamps
+	require.Equal(t, []string{" 4", " 6", " 8"}, counts)
+	require.NoError(t, h.close(context.Background()))
+}
+
+func TestServeMetricsAddrInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	_, err = serveMetrics(l.Addr().String(), (&config{}).openMetricsExporter(), &dryRunSink{})
+	require.Error(t, err)
+}
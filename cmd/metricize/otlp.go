@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/graphaelli/metricize"
+)
+
+const (
+	// outputOTLPJSON writes an OTLP/JSON ExportMetricsServiceRequest per line, one per rollup.
+	outputOTLPJSON = "otlp-json"
+	// outputOTLPProto writes a protobuf ExportMetricsServiceRequest per rollup, each preceded by its
+	// length as a 4 byte big endian integer, as the OpenTelemetry Collector's file exporter does.
+	outputOTLPProto = "otlp-proto"
+
+	// inputNDJSON reads documents, search hits, search responses or OTLP/JSON metrics requests, one per line.
+	inputNDJSON = "ndjson"
+	// inputOTLPProto reads protobuf ExportMetricsServiceRequests, as written with outputOTLPProto.
+	inputOTLPProto = "otlp-proto"
+
+	otlpExplicit    = "explicit"
+	otlpExponential = "exponential"
+)
+
+// otlpConfig controls how rollups are converted to, and sent as, OTLP metrics.
+type otlpConfig struct {
+	// Histogram is the histogram type, explicit or exponential.
+	Histogram string `json:"histogram"`
+	// Buckets are the explicit histogram bucket upper bounds in seconds.
+	Buckets []float64 `json:"buckets,omitempty"`
+	// Endpoint is the OTLP/HTTP endpoint rollups are pushed to instead of Elasticsearch.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Headers are comma separated key=value pairs sent with every OTLP/HTTP request.
+	Headers string `json:"headers,omitempty"`
+}
+
+func (c *otlpConfig) validate() error {
+	if c.Histogram != otlpExplicit && c.Histogram != otlpExponential {
+		return fmt.Errorf("unknown OTLP histogram %q, must be %q or %q", c.Histogram, otlpExplicit, otlpExponential)
+	}
+	_, err := c.headers()
+	return err
+}
+
+func (c *otlpConfig) headers() (http.Header, error) {
+	h := make(http.Header)
+	if c.Headers == "" {
+		return h, nil
+	}
+	for _, pair := range strings.Split(c.Headers, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid OTLP header %q, must be key=value", pair)
+		}
+		h.Set(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+	return h, nil
+}
+
+func (c *otlpConfig) exporter() metricize.OTLPExporter {
+	return metricize.OTLPExporter{
+		Exponential: c.Histogram == otlpExponential,
+		Buckets:     c.Buckets,
+		Scope:       &commonpb.InstrumentationScope{Name: "metricize", Version: toolVersion()},
+	}
+}
+
+// decodeOTLPProto reads length prefixed protobuf OTLP metrics requests, as written with outputOTLPProto, from r,
+// calling fn for each transaction metric they hold, as metricize.DecodeDocs does.
+func decodeOTLPProto(r io.Reader, fn func(*metricize.MetricDoc) error) (n, skipped int, err error) {
+	br := bufio.NewReader(r)
+	var size [4]byte
+	for msg := 1; ; msg++ {
+		if _, err := io.ReadFull(br, size[:]); err == io.EOF {
+			return n, skipped, nil
+		} else if err != nil {
+			return n, skipped, fmt.Errorf("message %d: %w", msg, err)
+		}
+		b := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(br, b); err != nil {
+			return n, skipped, fmt.Errorf("message %d: %w", msg, err)
+		}
+		var m metricspb.MetricsData
+		if err := proto.Unmarshal(b, &m); err != nil {
+			return n, skipped, fmt.Errorf("message %d: %w", msg, err)
+		}
+		s, err := metricize.OTLPMetricDocs(&m, func(doc *metricize.MetricDoc) error {
+			n++
+			return fn(doc)
+		})
+		skipped += s
+		if err != nil {
+			return n, skipped, err
+		}
+	}
+}
+
+// otlpFileSink writes rollups as OTLP requests to a file or stdout.
+type otlpFileSink struct {
+	mu       sync.Mutex
+	name     string
+	w        *bufio.Writer
+	c        io.Closer
+	proto    bool
+	exporter metricize.OTLPExporter
+
+	points, bytes int64
+}
+
+func newOTLPFileSink(path string, proto bool, exporter metricize.OTLPExporter) (*otlpFileSink, error) {
+	w, c, err := createOutput(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &otlpFileSink{name: path, w: bufio.NewWriter(w), c: c, proto: proto, exporter: exporter}
+	if path == "-" {
+		s.name = "stdout"
+	}
+	return s, nil
+}
+
+func (s *otlpFileSink) write(_ context.Context, logger *log.Logger, info *rollupInfo, a *metricize.Aggregator) error {
+	docs := decoratedDocs(info, a)
+	m, err := s.exporter.Metrics(docs)
+	if err != nil {
+		return err
+	}
+	var b []byte
+	if s.proto {
+		msg, err := proto.Marshal(m)
+		if err != nil {
+			return err
+		}
+		b = binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(msg)), uint32(len(msg)))
+		b = append(b, msg...)
+	} else {
+		// OTLP/JSON encodes enums as numbers
+		if b, err = (protojson.MarshalOptions{UseEnumNumbers: true}).Marshal(m); err != nil {
+			return err
+		}
+		b = append(b, '\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(b); err != nil {
+		return err
+	}
+	s.points += int64(len(docs))
+	s.bytes += int64(len(b))
+	logger.Printf("Wrote %d OTLP data points to %s", len(docs), s.name)
+	return nil
+}
+
+func (s *otlpFileSink) close(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.w.Flush()
+	if closeErr := s.c.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *otlpFileSink) stats() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("%d OTLP data points written, %d bytes to %s", s.points, s.bytes, s.name)
+}
+
+// otlpHTTPSink pushes rollups to an OTLP/HTTP endpoint, such as a local collector, as protobuf requests.
+type otlpHTTPSink struct {
+	client   *http.Client
+	url      string
+	headers  http.Header
+	exporter metricize.OTLPExporter
+	retry    retryConfig
+
+	mu                     sync.Mutex
+	points, requests, sent int64
+}
+
+func newOTLPHTTPSink(cfg otlpConfig, retry retryConfig) (*otlpHTTPSink, error) {
+	headers, err := cfg.headers()
+	if err != nil {
+		return nil, err
+	}
+	url := strings.TrimSuffix(cfg.Endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/metrics") {
+		url += "/v1/metrics"
+	}
+	return &otlpHTTPSink{
+		client:   &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()},
+		url:      url,
+		headers:  headers,
+		exporter: cfg.exporter(),
+		retry:    retry,
+	}, nil
+}
+
+func (s *otlpHTTPSink) write(ctx context.Context, logger *log.Logger, info *rollupInfo, a *metricize.Aggregator) error {
+	docs := decoratedDocs(info, a)
+	if len(docs) == 0 {
+		return nil
+	}
+	m, err := s.exporter.Metrics(docs)
+	if err != nil {
+		return err
+	}
+	body, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		for k, v := range s.headers {
+			req.Header[k] = v
+		}
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		rsp, err := s.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("while pushing OTLP metrics: %w", err)
+		}
+		msg, _ := io.ReadAll(io.LimitReader(rsp.Body, maxSampleLen))
+		rsp.Body.Close()
+		if rsp.StatusCode/100 == 2 {
+			break
+		}
+		retryable := false
+		for _, status := range retryOnStatus {
+			retryable = retryable || rsp.StatusCode == status
+		}
+		if !retryable || attempt >= s.retry.MaxRetries {
+			return fmt.Errorf("while pushing OTLP metrics: %s: %s", rsp.Status, msg)
+		}
+		// attempt counts the retries so far, the upcoming one is attempt+1
+		if err := s.retry.wait(ctx, attempt+1); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.points += int64(len(docs))
+	s.requests++
+	s.sent += int64(len(body))
+	logger.Printf("Pushed %d OTLP data points to %s", len(docs), s.url)
+	return nil
+}
+
+func (s *otlpHTTPSink) close(context.Context) error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+func (s *otlpHTTPSink) stats() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("%d OTLP data points pushed, %d bytes sent in %d requests", s.points, s.sent, s.requests)
+}
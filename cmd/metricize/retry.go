@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	esv8 "github.com/elastic/go-elasticsearch/v8"
+)
+
+// retryOnStatus lists the response status codes considered transient.
+var retryOnStatus = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// retryConfig controls how failed Elasticsearch requests and rejected bulk items are retried.
+type retryConfig struct {
+	// MaxRetries is the number of retries after the initial attempt, 0 disables retrying.
+	MaxRetries int
+	// Backoff is the delay before the first retry, doubling for each subsequent one.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration
+}
+
+// backoff returns the jittered exponential delay before retry attempt, starting at 1 for the first retry as the
+// Elasticsearch transport counts them.
+func (c retryConfig) backoff(attempt int) time.Duration {
+	d := c.Backoff
+	for i := 1; i < attempt && d < c.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	// pick uniformly from [d/2, d] so concurrent workers don't retry in lockstep
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// wait blocks for the backoff of retry attempt, starting at 1, returning early if ctx is done.
+func (c retryConfig) wait(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(c.backoff(attempt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// apply configures the client transport to retry network errors and transient responses.
+func (c retryConfig) apply(cfg *esv8.Config) {
+	if c.MaxRetries <= 0 {
+		cfg.DisableRetry = true
+		return
+	}
+	cfg.MaxRetries = c.MaxRetries
+	cfg.RetryOnStatus = retryOnStatus
+	cfg.RetryBackoff = c.backoff
+	cfg.RetryOnError = func(_ *http.Request, err error) bool {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	c := retryConfig{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, want := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		4: 800 * time.Millisecond,
+		// capped from then on
+		5:  time.Second,
+		50: time.Second,
+	} {
+		for i := 0; i < 100; i++ {
+			d := c.backoff(attempt)
+			require.GreaterOrEqual(t, d, want/2, "attempt %d", attempt)
+			require.LessOrEqual(t, d, want, "attempt %d", attempt)
+		}
+	}
+}
+
+func TestRetryBackoffDisabled(t *testing.T) {
+	require.Zero(t, retryConfig{}.backoff(1))
+	require.Zero(t, retryConfig{Backoff: time.Second}.backoff(3))
+}
+
+func TestRetryWaitCancelled(t *testing.T) {
+	c := retryConfig{Backoff: time.Hour, MaxBackoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.wait(ctx, 1)
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait not returning once cancelled")
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	c := retryConfig{Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	require.NoError(t, c.wait(context.Background(), 1))
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/graphaelli/metricize"
+)
+
+const (
+	// serveESVersion is the Elasticsearch version the bulk endpoint claims to be, for clients checking it.
+	serveESVersion = "8.5.0"
+	// maxBulkBytes limits bulk request bodies, as Elasticsearch's http.max_content_length does by default.
+	maxBulkBytes = 100 << 20
+)
+
+// ingester aggregates transaction metrics received through the bulk endpoint in memory, an aggregator per
+// interval, until the interval is flushed.
+type ingester struct {
+	step int64
+
+	mu          sync.Mutex
+	aggregators map[int64]*metricize.Aggregator
+	// closed is the start of the first interval still accepting documents
+	closed int64
+
+	requests, aggregated, late, discarded, rejected int64
+}
+
+var (
+	// errNotTransaction rejects documents other than transaction metrics.
+	errNotTransaction = errors.New("metricize only accepts transaction metrics")
+	// errLate rejects documents for intervals already written.
+	errLate = errors.New("the rollup of the interval of the document is already written")
+)
+
+// add aggregates doc into its interval.
+// Documents other than transaction metrics, and those for intervals already written, are rejected with
+// errNotTransaction and errLate, and counted in stats.
+func (g *ingester) add(doc *metricize.MetricDoc) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if doc.Metricset.Name != "transaction" {
+		g.discarded++
+		return errNotTransaction
+	}
+	bucket := doc.Timestamp.Unix()
+	bucket -= bucket % g.step
+	if doc.Timestamp.Unix() < bucket {
+		bucket -= g.step
+	}
+	if bucket < g.closed {
+		g.late++
+		return errLate
+	}
+	a, ok := g.aggregators[bucket]
+	if !ok {
+		a = metricize.NewAggregator(time.Unix(bucket, 0))
+		g.aggregators[bucket] = a
+	}
+	if err := a.Aggregate(doc); err != nil {
+		return err
+	}
+	g.aggregated++
+	return nil
+}
+
+// take closes every interval up to and including bucket, returning the start and aggregator of those holding
+// documents, in time order.
+func (g *ingester) take(bucket int64) ([]int64, []*metricize.Aggregator) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var starts []int64
+	var taken []*metricize.Aggregator
+	for b := g.closed; b <= bucket; b += g.step {
+		if a, ok := g.aggregators[b]; ok {
+			starts = append(starts, b)
+			taken = append(taken, a)
+			delete(g.aggregators, b)
+		}
+	}
+	if bucket+g.step > g.closed {
+		g.closed = bucket + g.step
+	}
+	return starts, taken
+}
+
+// discard drops the intervals still held, returning how many documents they aggregated.
+func (g *ingester) discard() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var docs int64
+	for b, a := range g.aggregators {
+		docs += a.Docs()
+		delete(g.aggregators, b)
+	}
+	return docs
+}
+
+// follow runs flush for every interval grace after it ends, from the first interval still accepting documents on,
+// until ctx is done or srvErr receives the error the server stopped with.
+func (g *ingester) follow(ctx context.Context, grace time.Duration, continueOnError bool, flush bucketFunc, srvErr <-chan error) error {
+	g.mu.Lock()
+	next := g.closed
+	g.mu.Unlock()
+	for ; ; next += g.step {
+		timer := time.NewTimer(time.Until(time.Unix(next+g.step, 0).Add(grace)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case err := <-srvErr:
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		// failures are logged by processBuckets when continuing on error, and are not failures when interrupted
+		if err := processBuckets(ctx, []int64{next}, 1, continueOnError, flush); err != nil && !continueOnError && ctx.Err() == nil {
+			return err
+		}
+	}
+}
+
+func (g *ingester) stats() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return fmt.Sprintf("%d bulk requests, %d docs aggregated, %d late, %d not transaction metrics, %d rejected",
+		g.requests, g.aggregated, g.late, g.discarded, g.rejected)
+}
+
+// bulkItem is the result of a bulk action, as Elasticsearch reports it.
+type bulkItem struct {
+	Index  string          `json:"_index,omitempty"`
+	ID     string          `json:"_id,omitempty"`
+	Status int             `json:"status"`
+	Result string          `json:"result,omitempty"`
+	Error  *bulkItemReason `json:"error,omitempty"`
+}
+
+type bulkItemReason struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// ServeHTTP implements enough of the Elasticsearch API for shippers to send documents through _bulk.
+func (g *ingester) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// clients checking they are talking to Elasticsearch look for this on every response
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	switch {
+	case r.URL.Path == "/" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"name":         "metricize",
+			"cluster_name": "metricize",
+			"version": map[string]interface{}{
+				"number":       serveESVersion,
+				"build_flavor": "default",
+			},
+			"tagline": "You Know, for Search",
+		})
+	case (r.URL.Path == "/_bulk" || strings.HasSuffix(r.URL.Path, "/_bulk")) &&
+		(r.Method == http.MethodPost || r.Method == http.MethodPut):
+		g.serveBulk(w, r)
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"error": bulkItemReason{
+				Type:   "illegal_argument_exception",
+				Reason: fmt.Sprintf("metricize only accepts bulk requests, not %s %s", r.Method, r.URL.Path),
+			},
+			"status": http.StatusNotFound,
+		})
+	}
+}
+
+func (g *ingester) serveBulk(w http.ResponseWriter, r *http.Request) {
+	began := time.Now()
+	var body io.Reader = http.MaxBytesReader(w, r.Body, maxBulkBytes)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			writeBulkError(w, "parse_exception", err)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	// documents go to the index of their action, or that of the path
+	defaultIndex := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "_bulk")
+	defaultIndex = strings.TrimSuffix(defaultIndex, "/")
+
+	// the whole body is read before anything is aggregated, so that a request failing as a whole leaves nothing
+	// behind to be aggregated twice when the client sends it again
+	type bulkOp struct {
+		action string
+		item   bulkItem
+		doc    *metricize.MetricDoc
+	}
+	var ops []bulkOp
+	dec := json.NewDecoder(body)
+	for {
+		var action map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		if err := dec.Decode(&action); err == io.EOF {
+			break
+		} else if err != nil || len(action) != 1 {
+			if err == nil {
+				err = fmt.Errorf("expected a single action, got %d", len(action))
+			}
+			writeBulkError(w, "illegal_argument_exception", fmt.Errorf("malformed action: %w", err))
+			return
+		}
+		for name, meta := range action {
+			op := bulkOp{action: name, item: bulkItem{Index: meta.Index, ID: meta.ID}}
+			if op.item.Index == "" {
+				op.item.Index = defaultIndex
+			}
+			if name != "delete" {
+				var raw json.RawMessage
+				if err := dec.Decode(&raw); err != nil {
+					writeBulkError(w, "illegal_argument_exception", fmt.Errorf("malformed source of %s action: %w", name, err))
+					return
+				}
+				if name == "index" || name == "create" {
+					var doc metricize.MetricDoc
+					if err := json.Unmarshal(raw, &doc); err != nil {
+						op.item.Status, op.item.Error = http.StatusBadRequest, &bulkItemReason{
+							Type:   "document_parsing_exception",
+							Reason: err.Error(),
+						}
+					} else {
+						op.doc = &doc
+					}
+				}
+			}
+			if op.doc == nil && op.item.Error == nil {
+				op.item.Status, op.item.Error = http.StatusBadRequest, &bulkItemReason{
+					Type:   "illegal_argument_exception",
+					Reason: "metricize only accepts index and create actions",
+				}
+			}
+			ops = append(ops, op)
+		}
+	}
+
+	items := make([]map[string]bulkItem, len(ops))
+	var failed bool
+	var late, rejected int64
+	for i := range ops {
+		op := &ops[i]
+		if op.doc == nil {
+			rejected++
+		} else if err := g.add(op.doc); err == nil {
+			op.item.Status, op.item.Result = http.StatusCreated, "created"
+		} else {
+			reason := err.Error()
+			switch {
+			case errors.Is(err, errLate):
+				late++
+			case !errors.Is(err, errNotTransaction):
+				reason = fmt.Sprintf("while aggregating: %s", err)
+				rejected++
+			}
+			op.item.Status, op.item.Error = http.StatusBadRequest, &bulkItemReason{
+				Type:   "illegal_argument_exception",
+				Reason: reason,
+			}
+		}
+		if op.item.Error != nil {
+			failed = true
+		}
+		items[i] = map[string]bulkItem{op.action: op.item}
+	}
+	if late > 0 {
+		log.Printf("rejected %d docs for intervals already written, consider a longer -serve-grace", late)
+	}
+	g.mu.Lock()
+	g.requests++
+	g.rejected += rejected
+	g.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"took":   time.Since(began).Milliseconds(),
+		"errors": failed,
+		"items":  items,
+	})
+}
+
+// writeBulkError answers a bulk request failing as a whole, as Elasticsearch does.
+func writeBulkError(w http.ResponseWriter, typ string, err error) {
+	status := http.StatusBadRequest
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		status, typ = http.StatusRequestEntityTooLarge, "content_too_long_exception"
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"error":  bulkItemReason{Type: typ, Reason: err.Error()},
+		"status": status,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("while writing response: %s", err)
+	}
+}
+
+// runServe accepts transaction metrics on an Elasticsearch compatible _bulk endpoint, aggregating them in memory
+// and writing the rollup of each interval cfg.Serve.Grace after it ends, until interrupted.
+// On the way out, intervals that have ended are written without waiting out the grace period, while those still
+// open are discarded rather than written as if complete.
+func runServe(cfg *config) error {
+	if cfg.Input != "" {
+		return errors.New("serve reads documents from its bulk endpoint, not -input")
+	}
+	if cfg.Filters.isSet() {
+		return errors.New("filters only apply when reading from Elasticsearch")
+	}
+	interval := time.Duration(cfg.Interval)
+	retry := retryConfig{
+		MaxRetries: cfg.Retry.MaxRetries,
+		Backoff:    time.Duration(cfg.Retry.Backoff),
+		MaxBackoff: time.Duration(cfg.Retry.MaxBackoff),
+	}
+	// with nothing to read from, rollups are written to the destination cluster if set, the source otherwise
+	flags := cfg.Destination.orFallback(&cfg.Source)
+	destES, err := newClient(flags, retry, cfg.Bulk.Compress)
+	if err != nil {
+		return err
+	}
+	target, err := cfg.Target.resolve(interval)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	out, err := openSink(ctx, cfg, destES, target.String(), retry)
+	if err != nil {
+		return err
+	}
+	if cfg.OpenMetrics.Addr != "" {
+		if out, err = serveMetrics(cfg.OpenMetrics.Addr, cfg.openMetricsExporter(), out); err != nil {
+			return err
+		}
+	}
+
+	step := int64(interval.Seconds())
+	info := &rollupInfo{
+		Target: target,
+		Period: step,
+		Provenance: metricize.Provenance{
+			SourceIndex: "_bulk",
+			Version:     toolVersion(),
+			RunID:       newRunID(),
+		},
+		Observer: cfg.Observer,
+	}
+	now := time.Now().Unix()
+	g := &ingester{step: step, aggregators: make(map[int64]*metricize.Aggregator)}
+	// documents are accepted from the interval in progress on
+	g.closed = now - now%step
+
+	srv := &http.Server{Addr: cfg.Serve.Addr, Handler: g}
+	srvErr := make(chan error, 1)
+	go func() {
+		srvErr <- srv.ListenAndServe()
+	}()
+	log.Printf("accepting bulk requests on http://%s/_bulk, rolling up into %s, run ID %s",
+		cfg.Serve.Addr, target.String(), info.Provenance.RunID)
+
+	flush := func(ctx context.Context, logger *log.Logger, bucket int64) error {
+		starts, aggregators := g.take(bucket)
+		for i, a := range aggregators {
+			logger.Printf("rolling up %s, %d keys", time.Unix(starts[i], 0).String(), len(a.Buckets))
+			if err := out.write(ctx, logger, info, a); err != nil {
+				return fmt.Errorf("while writing rollup: %w", err)
+			}
+		}
+		return nil
+	}
+	err = g.follow(ctx, time.Duration(cfg.Serve.Grace), cfg.ContinueOnError, flush, srvErr)
+
+	// stop accepting documents, then write the intervals that have ended
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if shutdownErr := srv.Shutdown(shutdownCtx); shutdownErr != nil {
+		log.Printf("while shutting down: %s", shutdownErr)
+	}
+	ctx = context.Background()
+	if err == nil {
+		now := time.Now().Unix()
+		err = processBuckets(ctx, []int64{now - now%step - step}, 1, cfg.ContinueOnError, flush)
+	}
+	if docs := g.discard(); docs > 0 {
+		log.Printf("discarding %d docs of intervals still open, their rollups would be incomplete", docs)
+	}
+	if closeErr := out.close(ctx); err == nil {
+		err = closeErr
+	}
+	log.Print(g.stats())
+	log.Print(out.stats())
+	return err
+}
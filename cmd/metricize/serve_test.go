@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/graphaelli/metricize"
+)
+
+// newTestIngester returns an ingester of 10 minute intervals accepting documents from start on.
+func newTestIngester(start time.Time) *ingester {
+	return &ingester{step: 600, aggregators: make(map[int64]*metricize.Aggregator), closed: start.Unix()}
+}
+
+// bulkBody returns the NDJSON body of a bulk request, encoding lines other than strings as JSON.
+func bulkBody(t *testing.T, lines ...interface{}) string {
+	var body strings.Builder
+	for _, line := range lines {
+		s, ok := line.(string)
+		if !ok {
+			b, err := json.Marshal(line)
+			require.NoError(t, err)
+			s = string(b)
+		}
+		body.WriteString(s + "\n")
+	}
+	return body.String()
+}
+
+type bulkResponse struct {
+	Errors bool                  `json:"errors"`
+	Items  []map[string]bulkItem `json:"items"`
+	Status int                   `json:"status"`
+}
+
+func serveTestBulk(t *testing.T, g *ingester, body string) (int, bulkResponse) {
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/metrics-apm.internal-default/_bulk", strings.NewReader(body)))
+	var rsp bulkResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &rsp))
+	return w.Code, rsp
+}
+
+// statuses returns the status of every item of rsp.
+func (rsp bulkResponse) statuses() []int {
+	var statuses []int
+	for _, item := range rsp.Items {
+		for _, result := range item {
+			statuses = append(statuses, result.Status)
+		}
+	}
+	return statuses
+}
+
+// aggregatedDocs returns the number of documents held by g.
+func aggregatedDocs(g *ingester) int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var docs int64
+	for _, a := range g.aggregators {
+		docs += a.Docs()
+	}
+	return docs
+}
+
+func TestServeBulk(t *testing.T) {
+	start := time.Unix(1670000400, 0)
+	g := newTestIngester(start)
+	docs := sourceDocs(start, 3, 3)
+	other := docs[2]
+	other.Metricset.Name = "service_destination"
+
+	code, rsp := serveTestBulk(t, g, bulkBody(t,
+		`{"create":{}}`, docs[0],
+		`{"index":{"_index":"metrics-apm.internal-other"}}`, docs[1],
+		`{"create":{}}`, other,
+		`{"delete":{"_id":"1"}}`,
+	))
+	require.Equal(t, http.StatusOK, code)
+	require.True(t, rsp.Errors)
+	require.Equal(t, []int{http.StatusCreated, http.StatusCreated, http.StatusBadRequest, http.StatusBadRequest}, rsp.statuses())
+	require.Equal(t, "metrics-apm.internal-default", rsp.Items[0]["create"].Index)
+	require.Equal(t, "metrics-apm.internal-other", rsp.Items[1]["index"].Index)
+	require.Equal(t, errNotTransaction.Error(), rsp.Items[2]["create"].Error.Reason)
+	require.EqualValues(t, 2, aggregatedDocs(g))
+	require.Contains(t, g.stats(), "1 bulk requests, 2 docs aggregated, 0 late, 1 not transaction metrics, 1 rejected")
+}
+
+func TestServeBulkMalformed(t *testing.T) {
+	start := time.Unix(1670000400, 0)
+	doc := sourceDocs(start, 1, 1)[0]
+	for name, body := range map[string]string{
+		"action": bulkBody(t, `{"create":{}}`, doc, `{"create":{}`, doc),
+		"source": bulkBody(t, `{"create":{}}`, doc, `{"create":{}}`, `{"transaction":`),
+		"count":  bulkBody(t, `{"create":{}}`, doc, `{"create":{},"index":{}}`, doc),
+	} {
+		g := newTestIngester(start)
+		code, rsp := serveTestBulk(t, g, body)
+		require.Equal(t, http.StatusBadRequest, code, name)
+		require.Equal(t, http.StatusBadRequest, rsp.Status, name)
+		// nothing is aggregated for the client to send again
+		require.Zero(t, aggregatedDocs(g), name)
+	}
+}
+
+func TestServeBulkLate(t *testing.T) {
+	start := time.Unix(1670000400, 0)
+	g := newTestIngester(start)
+	docs := sourceDocs(start, 2, 1)
+	next := docs[1]
+	next.Timestamp = start.Add(10 * time.Minute)
+	// the first interval is written
+	g.take(start.Unix())
+
+	code, rsp := serveTestBulk(t, g, bulkBody(t, `{"create":{}}`, docs[0], `{"create":{}}`, next))
+	require.Equal(t, http.StatusOK, code)
+	require.True(t, rsp.Errors)
+	require.Equal(t, []int{http.StatusBadRequest, http.StatusCreated}, rsp.statuses())
+	require.Equal(t, errLate.Error(), rsp.Items[0]["create"].Error.Reason)
+	require.EqualValues(t, 1, aggregatedDocs(g))
+	require.Contains(t, g.stats(), "1 docs aggregated, 1 late")
+}
+
+func TestIngesterFollow(t *testing.T) {
+	// one second intervals, so that one ends shortly
+	now := time.Now().Unix()
+	g := &ingester{step: 1, aggregators: make(map[int64]*metricize.Aggregator), closed: now}
+	doc := sourceDocs(time.Unix(now, 0), 1, 1)[0]
+	require.NoError(t, g.add(&doc))
+
+	flushed := make(chan *metricize.Aggregator, 1)
+	flush := func(_ context.Context, _ *log.Logger, bucket int64) error {
+		_, taken := g.take(bucket)
+		for _, a := range taken {
+			flushed <- a
+		}
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- g.follow(ctx, 0, false, flush, nil)
+	}()
+
+	select {
+	case a := <-flushed:
+		require.EqualValues(t, 1, a.Docs())
+	case <-time.After(5 * time.Second):
+		t.Fatal("interval not flushed once over")
+	}
+	// documents for the interval flushed are late from then on
+	require.ErrorIs(t, g.add(&doc), errLate)
+
+	cancel()
+	require.NoError(t, <-done)
+}
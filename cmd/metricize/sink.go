@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/graphaelli/metricize"
+)
+
+const (
+	// outputDocs writes one rollup document per line.
+	outputDocs = "docs"
+	// outputBulk writes a bulk request body, each document preceded by a create action.
+	outputBulk = "bulk"
+	// outputCSV writes a CSV row per rollup document, with duration percentiles.
+	outputCSV = "csv"
+	// outputParquet writes a Parquet file with a row per rollup document, with duration percentiles.
+	outputParquet = "parquet"
+)
+
+// sink receives rollup documents.
+type sink interface {
+	// write writes a document for every bucket of a, decorated by info, returning once they are written.
+	write(ctx context.Context, logger *log.Logger, info *rollupInfo, a *metricize.Aggregator) error
+	// close flushes and releases the sink.
+	close(ctx context.Context) error
+	// stats summarizes everything written.
+	stats() string
+}
+
+var (
+	_ sink = (*bulkWriter)(nil)
+	_ sink = (*ndjsonSink)(nil)
+	_ sink = (*dryRunSink)(nil)
+	_ sink = (*exportSink)(nil)
+	_ sink = (*rowSink)(nil)
+	_ sink = (*metricsHandler)(nil)
+	_ sink = (*otlpFileSink)(nil)
+	_ sink = (*otlpHTTPSink)(nil)
+)
+
+// exporter writes rollup documents in a format that can only be written as a whole.
+type exporter interface {
+	Write(w io.Writer, docs []metricize.MetricDoc) error
+}
+
+// exportSink collects every rollup in memory, exporting them all to a file on close.
+type exportSink struct {
+	mu       sync.Mutex
+	path     string
+	exporter exporter
+	docs     []metricize.MetricDoc
+}
+
+func (s *exportSink) write(_ context.Context, logger *log.Logger, info *rollupInfo, a *metricize.Aggregator) error {
+	docs := decoratedDocs(info, a)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.docs = append(s.docs, docs...)
+	logger.Printf("Collected %d rollup docs for %s", len(docs), s.path)
+	return nil
+}
+
+func (s *exportSink) close(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, c, err := createOutput(s.path)
+	if err != nil {
+		return err
+	}
+	if err := s.exporter.Write(w, s.docs); err != nil {
+		c.Close()
+		return err
+	}
+	return c.Close()
+}
+
+func (s *exportSink) stats() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("%d rollup docs written to %s", len(s.docs), s.path)
+}
+
+// rowWriter writes rollup documents a batch at a time, as metricize.CSVWriter and metricize.ParquetWriter do.
+type rowWriter interface {
+	Write(docs []metricize.MetricDoc) error
+	Close() error
+}
+
+// rowSink writes the rollups of each bucket to a file as a batch of rows, rather than collecting them all.
+type rowSink struct {
+	mu   sync.Mutex
+	name string
+	w    *bufio.Writer
+	c    io.Closer
+	rows rowWriter
+	docs int64
+}
+
+// newRowSink creates a sink writing to path, or stdout for "-", through the rowWriter newWriter returns,
+// compressed according to the file extension.
+func newRowSink(path string, newWriter func(io.Writer) rowWriter) (*rowSink, error) {
+	w, c, err := createOutput(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &rowSink{name: path, w: bufio.NewWriter(w), c: c}
+	if path == "-" {
+		s.name = "stdout"
+	}
+	s.rows = newWriter(s.w)
+	return s, nil
+}
+
+func (s *rowSink) write(_ context.Context, logger *log.Logger, info *rollupInfo, a *metricize.Aggregator) error {
+	docs := decoratedDocs(info, a)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.rows.Write(docs); err != nil {
+		return err
+	}
+	s.docs += int64(len(docs))
+	logger.Printf("Wrote %d rollup docs to %s", len(docs), s.name)
+	return nil
+}
+
+func (s *rowSink) close(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.rows.Close()
+	if flushErr := s.w.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := s.c.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *rowSink) stats() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("%d rollup docs written to %s", s.docs, s.name)
+}
+
+// ndjsonSink writes rollup documents as NDJSON to a file or stdout.
+type ndjsonSink struct {
+	mu     sync.Mutex
+	name   string
+	w      *bufio.Writer
+	c      io.Closer
+	format string
+	ids    bool
+
+	docs, bytes int64
+}
+
+// newFileSink creates the sink writing rollups to path, or stdout for "-", in the output format of cfg.
+func newFileSink(cfg *config, path string) (sink, error) {
+	switch cfg.OutputFormat {
+	case outputOpenMetrics:
+		// files hold every bucket, for backfilling, so samples carry the time of their rollup
+		exporter := cfg.openMetricsExporter()
+		exporter.Timestamps = true
+		return &exportSink{path: path, exporter: &exporter}, nil
+	case outputCSV:
+		e := metricize.CSVExporter{Percentiles: cfg.Percentiles}
+		return newRowSink(path, func(w io.Writer) rowWriter { return e.NewWriter(w) })
+	case outputParquet:
+		e := metricize.ParquetExporter{Percentiles: cfg.Percentiles}
+		return newRowSink(path, func(w io.Writer) rowWriter { return e.NewWriter(w) })
+	case outputOTLPJSON, outputOTLPProto:
+		return newOTLPFileSink(path, cfg.OutputFormat == outputOTLPProto, cfg.OTLP.exporter())
+	}
+	return newNDJSONSink(path, cfg.OutputFormat, cfg.Bulk.DeterministicIDs)
+}
+
+// newNDJSONSink creates a sink writing to path, or stdout for "-", in the given format,
+// compressed according to the file extension.
+// ids adds deterministic document IDs to bulk actions.
+func newNDJSONSink(path, format string, ids bool) (*ndjsonSink, error) {
+	w, c, err := createOutput(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &ndjsonSink{name: path, w: bufio.NewWriter(w), c: c, format: format, ids: ids}
+	if path == "-" {
+		s.name = "stdout"
+	}
+	return s, nil
+}
+
+// write writes the documents of a in a stable order so that runs can be diffed.
+func (s *ndjsonSink) write(_ context.Context, logger *log.Logger, info *rollupInfo, a *metricize.Aggregator) error {
+	type line struct {
+		id  string
+		doc []byte
+	}
+	lines := make([]line, 0, len(a.Buckets))
+	for key := range a.Buckets {
+		doc := a.Emit(key)
+		info.decorate(&doc)
+		b, err := json.Marshal(&doc)
+		if err != nil {
+			return err
+		}
+		l := line{doc: b}
+		if s.ids {
+			l.id = a.DocumentID(key, info.Period)
+		}
+		lines = append(lines, l)
+	}
+	sort.Slice(lines, func(i, j int) bool { return bytes.Compare(lines[i].doc, lines[j].doc) < 0 })
+
+	// buckets written concurrently must not interleave
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var written int64
+	for _, l := range lines {
+		if s.format == outputBulk {
+			action := map[string]interface{}{"_index": info.Target.String()}
+			if l.id != "" {
+				action["_id"] = l.id
+			}
+			b, err := json.Marshal(map[string]interface{}{"create": action})
+			if err != nil {
+				return err
+			}
+			n, err := s.w.Write(append(b, '\n'))
+			written += int64(n)
+			if err != nil {
+				return err
+			}
+		}
+		n, err := s.w.Write(append(l.doc, '\n'))
+		written += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	s.docs += int64(len(lines))
+	s.bytes += written
+	logger.Printf("Wrote %d metrics docs to %s", len(lines), s.name)
+	return nil
+}
+
+func (s *ndjsonSink) close(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.w.Flush()
+	if closeErr := s.c.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *ndjsonSink) stats() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("%d docs written, %d bytes to %s", s.docs, s.bytes, s.name)
+}
+
+// dryRunSink writes nothing, reporting what each rollup would have written instead.
+type dryRunSink struct {
+	mu                                sync.Mutex
+	buckets, sourceDocs, transactions int64
+	docs, counts, bytes               int64
+}
+
+func (s *dryRunSink) write(_ context.Context, logger *log.Logger, info *rollupInfo, a *metricize.Aggregator) error {
+	var counts, size int64
+	for key := range a.Buckets {
+		doc := a.Emit(key)
+		info.decorate(&doc)
+		for _, c := range doc.Transaction.DurationHistogram.Counts {
+			counts += c
+		}
+		b, err := json.Marshal(&doc)
+		if err != nil {
+			return err
+		}
+		size += int64(len(b))
+	}
+	sourceDocs, transactions := a.Docs(), a.Transactions()
+	logger.Printf("dry run: %d source docs read summarizing %d transactions, %d rollup docs with %d histogram counts, %d bytes would be written to %s",
+		sourceDocs, transactions, len(a.Buckets), counts, size, info.Target)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets++
+	s.sourceDocs += sourceDocs
+	s.transactions += transactions
+	s.docs += int64(len(a.Buckets))
+	s.counts += counts
+	s.bytes += size
+	return nil
+}
+
+func (s *dryRunSink) close(context.Context) error {
+	return nil
+}
+
+func (s *dryRunSink) stats() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("dry run: %d buckets, %d source docs read summarizing %d transactions, %d rollup docs with %d histogram counts, %d bytes would be written",
+		s.buckets, s.sourceDocs, s.transactions, s.docs, s.counts, s.bytes)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/graphaelli/metricize"
+)
+
+// writeNDJSON returns what an ndjsonSink in format writes for the rollups of 2 services.
+func writeNDJSON(t *testing.T, format string, ids bool) string {
+	path := filepath.Join(t.TempDir(), "rollups.ndjson")
+	s, err := newNDJSONSink(path, format, ids)
+	require.NoError(t, err)
+	target, err := targetConfig{Type: "metrics", Dataset: "apm.transaction_rollup.{{.Interval}}", Namespace: "default"}.resolve(10 * time.Minute)
+	require.NoError(t, err)
+	info := &rollupInfo{Target: target, Period: 600}
+	start := time.Unix(1670000400, 0)
+	a := metricize.NewAggregator(start)
+	for _, doc := range sourceDocs(start, 2, 2) {
+		// short histograms, for readable output
+		doc.DurationHistogram = metricize.DurationHistogram{Values: []int64{1, 3}, Counts: []int64{1, 2}}
+		require.NoError(t, a.Aggregate(&doc))
+	}
+	require.NoError(t, s.write(context.Background(), log.New(io.Discard, "", 0), info, a))
+	require.NoError(t, s.close(context.Background()))
+	require.Contains(t, s.stats(), "2 docs written")
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(b)
+}
+
+// rollupLines are the rollup documents written for the 2 services, in order.
+var rollupLines = []string{
+	`{"@timestamp":"2022-12-02T17:00:00Z","agent":{"name":"go"},"cloud":{"account":{},"machine":{},"project":{}},"container":{},"host":{"os":{}},"event":{},"kubernetes":{"pod":{}},"data_stream":{"type":"metrics","dataset":"apm.transaction_rollup.10m","namespace":"default"},"metricset":{"name":"transaction_rollup","interval":"10m"},"metricize":{},"numeric_labels":{"rollup_period":600},"observer":{"version":"8.5.0"},"service":{"name":"service-0","node":{},"language":{},"runtime":{}},"transaction":{"name":"GET /","type":"request","duration.histogram":{"counts":[0,1,0,2],"values":[0,1,2,3]},"duration.summary":{"sum":7,"value_count":3}}}`,
+	`{"@timestamp":"2022-12-02T17:00:00Z","agent":{"name":"go"},"cloud":{"account":{},"machine":{},"project":{}},"container":{},"host":{"os":{}},"event":{},"kubernetes":{"pod":{}},"data_stream":{"type":"metrics","dataset":"apm.transaction_rollup.10m","namespace":"default"},"metricset":{"name":"transaction_rollup","interval":"10m"},"metricize":{},"numeric_labels":{"rollup_period":600},"observer":{"version":"8.5.0"},"service":{"name":"service-1","node":{},"language":{},"runtime":{}},"transaction":{"name":"GET /","type":"request","duration.histogram":{"counts":[0,1,0,2],"values":[0,1,2,3]},"duration.summary":{"sum":7,"value_count":3}}}`,
+}
+
+func TestNDJSONSinkDocs(t *testing.T) {
+	require.Equal(t, rollupLines[0]+"\n"+rollupLines[1]+"\n", writeNDJSON(t, outputDocs, false))
+}
+
+func TestNDJSONSinkBulk(t *testing.T) {
+	require.Equal(t,
+		`{"create":{"_index":"metrics-apm.transaction_rollup.10m-default"}}`+"\n"+rollupLines[0]+"\n"+
+			`{"create":{"_index":"metrics-apm.transaction_rollup.10m-default"}}`+"\n"+rollupLines[1]+"\n",
+		writeNDJSON(t, outputBulk, false))
+}
+
+func TestNDJSONSinkBulkIDs(t *testing.T) {
+	require.Equal(t,
+		`{"create":{"_id":"6b7140541d572b78","_index":"metrics-apm.transaction_rollup.10m-default"}}`+"\n"+rollupLines[0]+"\n"+
+			`{"create":{"_id":"19cd6d132288b125","_index":"metrics-apm.transaction_rollup.10m-default"}}`+"\n"+rollupLines[1]+"\n",
+		writeNDJSON(t, outputBulk, true))
+}
+
+func TestDryRunSink(t *testing.T) {
+	start := time.Unix(1670000400, 0)
+	a := metricize.NewAggregator(start)
+	for _, doc := range sourceDocs(start, 4, 2) {
+		// each document summarizing several transactions
+		doc.DocCount = 5
+		require.NoError(t, a.Aggregate(&doc))
+	}
+	target, err := targetConfig{Type: "metrics", Dataset: "apm.transaction_rollup.{{.Interval}}", Namespace: "default"}.resolve(10 * time.Minute)
+	require.NoError(t, err)
+	info := &rollupInfo{Target: target, Period: 600}
+	var logs strings.Builder
+	logger := log.New(&logs, "", 0)
+	s := &dryRunSink{}
+	// the same rollup twice, as two buckets would be
+	require.NoError(t, s.write(context.Background(), logger, info, a))
+	require.NoError(t, s.write(context.Background(), logger, info, a))
+	require.Contains(t, logs.String(), "dry run: 4 source docs read summarizing 20 transactions, 2 rollup docs with 11 histogram counts")
+	require.Contains(t, s.stats(), "dry run: 2 buckets, 8 source docs read summarizing 40 transactions, 4 rollup docs with 22 histogram counts")
+}
+
+func TestRowSinkCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rollups.csv")
+	cfg := &config{OutputFormat: outputCSV}
+	s, err := newFileSink(cfg, path)
+	require.NoError(t, err)
+	require.IsType(t, &rowSink{}, s)
+	// rollups are written bucket by bucket, under a single header
+	for i := 0; i < 2; i++ {
+		info, a := testRollup(t, 2)
+		require.NoError(t, s.write(context.Background(), log.New(io.Discard, "", 0), info, a))
+	}
+	require.NoError(t, s.close(context.Background()))
+	require.Equal(t, "4 rollup docs written to "+path, s.stats())
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	require.Len(t, lines, 5)
+	require.True(t, strings.HasPrefix(lines[0], "@timestamp,"))
+	for _, line := range lines[1:] {
+		require.True(t, strings.HasPrefix(line, "2022-12-02T17:00:00Z,"), line)
+	}
+}
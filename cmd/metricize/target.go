@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/graphaelli/metricize"
+)
+
+// targetConfig names the data stream rollups are written to.
+// Each part is a text/template with access to the rollup {{.Interval}}, formatted such as 10m or 1h, and the
+// same interval as a {{.Duration}} such as 10m0s or 1h0m0s.
+type targetConfig struct {
+	Type      string `json:"type"`
+	Dataset   string `json:"dataset"`
+	Namespace string `json:"namespace"`
+}
+
+// resolve renders the target data stream for interval and validates it.
+func (c targetConfig) resolve(interval time.Duration) (metricize.DataStream, error) {
+	data := struct{ Interval, Duration string }{Interval: metricize.FormatInterval(interval), Duration: interval.String()}
+	var ds metricize.DataStream
+	for _, part := range []struct {
+		text string
+		dst  *string
+	}{
+		{c.Type, &ds.Type},
+		{c.Dataset, &ds.Dataset},
+		{c.Namespace, &ds.Namespace},
+	} {
+		t, err := template.New("").Option("missingkey=error").Parse(part.text)
+		if err != nil {
+			return ds, err
+		}
+		var b strings.Builder
+		if err := t.Execute(&b, &data); err != nil {
+			return ds, err
+		}
+		*part.dst = b.String()
+	}
+	return ds, ds.Validate()
+}
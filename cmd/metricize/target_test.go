@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTargetDefault(t *testing.T) {
+	var c config
+	c.registerFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+	// the data stream rollups were always written to, so that existing rollups are found
+	for interval, expected := range map[time.Duration]string{
+		10 * time.Minute: "metrics-apm.internal-rollup10m0s",
+		time.Hour:        "metrics-apm.internal-rollup1h0m0s",
+	} {
+		target, err := c.Target.resolve(interval)
+		require.NoError(t, err)
+		require.Equal(t, expected, target.String())
+	}
+
+	c.Target.Dataset, c.Target.Namespace = "apm.transaction_rollup.{{.Interval}}", "default"
+	target, err := c.Target.resolve(10 * time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, "metrics-apm.transaction_rollup.10m-default", target.String())
+}
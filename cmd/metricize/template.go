@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	esv8 "github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+
+	"github.com/graphaelli/metricize"
+)
+
+const (
+	// templateInstall installs the index template, and lifecycle policy, for the target data stream.
+	templateInstall = "install"
+	// templateVerify warns unless the target data stream maps rollup fields correctly.
+	templateVerify = "verify"
+	// templateSkip relies on whatever templates already exist.
+	templateSkip = "skip"
+
+	// templatePriority outranks the templates installed by Fleet for the APM integration.
+	templatePriority = 300
+)
+
+// timeUnits are the units accepted in Elasticsearch time values.
+var timeUnits = map[string]bool{"d": true, "h": true, "m": true, "s": true, "ms": true, "micros": true, "nanos": true}
+
+// byteUnits are the units accepted in Elasticsearch byte size values.
+var byteUnits = map[string]bool{"b": true, "kb": true, "mb": true, "gb": true, "tb": true, "pb": true}
+
+// templateConfig controls the index template installed for the target data stream.
+type templateConfig struct {
+	Setup string `json:"setup"`
+	// TSDS enables time series data stream mode, which requires Elasticsearch generated document IDs.
+	TSDS bool `json:"tsds"`
+	// ILMPolicy names the lifecycle policy managing rollup indices.
+	ILMPolicy string `json:"ilm_policy"`
+	// Retention is how long rollups are kept, such as "90d", empty to keep them forever.
+	Retention string `json:"retention,omitempty"`
+	// RolloverMaxAge and RolloverMaxPrimaryShardSize are the rollover conditions of the lifecycle policy.
+	RolloverMaxAge              string `json:"rollover_max_age"`
+	RolloverMaxPrimaryShardSize string `json:"rollover_max_primary_shard_size"`
+}
+
+func (c *templateConfig) validate() error {
+	switch c.Setup {
+	case templateInstall, templateVerify, templateSkip:
+	default:
+		return fmt.Errorf("unknown template setup %q, must be %q, %q or %q", c.Setup, templateInstall, templateVerify, templateSkip)
+	}
+	if c.Retention != "" && !hasUnit(c.Retention, timeUnits) {
+		return fmt.Errorf("invalid retention %q, must be a number followed by a time unit such as 90d", c.Retention)
+	}
+	if !hasUnit(c.RolloverMaxAge, timeUnits) {
+		return fmt.Errorf("invalid rollover max age %q, must be a number followed by a time unit such as 30d", c.RolloverMaxAge)
+	}
+	if !hasUnit(c.RolloverMaxPrimaryShardSize, byteUnits) {
+		return fmt.Errorf("invalid rollover max primary shard size %q, must be a number followed by a byte unit such as 50gb", c.RolloverMaxPrimaryShardSize)
+	}
+	return nil
+}
+
+// hasUnit reports whether v is a whole number followed by one of units.
+func hasUnit(v string, units map[string]bool) bool {
+	unit := strings.TrimLeft(v, "0123456789")
+	return unit != v && units[unit]
+}
+
+// rollupMappings returns the mappings for rollup documents.
+func rollupMappings(tsds bool) map[string]interface{} {
+	properties := map[string]interface{}{
+		"@timestamp": map[string]interface{}{"type": "date"},
+		"data_stream": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"type":      map[string]interface{}{"type": "constant_keyword"},
+				"dataset":   map[string]interface{}{"type": "constant_keyword"},
+				"namespace": map[string]interface{}{"type": "constant_keyword"},
+			},
+		},
+		"metricset": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"name":     map[string]interface{}{"type": "keyword"},
+				"interval": map[string]interface{}{"type": "keyword"},
+			},
+		},
+		"metricize": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"source_index": map[string]interface{}{"type": "keyword"},
+				"version":      map[string]interface{}{"type": "keyword"},
+				"run_id":       map[string]interface{}{"type": "keyword"},
+			},
+		},
+		"numeric_labels": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"rollup_period": map[string]interface{}{"type": "long"},
+			},
+		},
+	}
+	for _, field := range metricize.KeyFields() {
+		var mapping map[string]interface{}
+		switch {
+		case tsds:
+			// dimensions cannot ignore values, and must be keywords: transaction.root is indexed as "true"
+			mapping = map[string]interface{}{"type": "keyword", "time_series_dimension": true}
+		case field == "transaction.root":
+			mapping = map[string]interface{}{"type": "boolean"}
+		default:
+			mapping = map[string]interface{}{"type": "keyword", "ignore_above": 1024}
+		}
+		setMapping(properties, field, mapping)
+	}
+	setMapping(properties, durationHistogramField, map[string]interface{}{"type": "histogram"})
+	setMapping(properties, durationSummaryField, map[string]interface{}{
+		"type":           "aggregate_metric_double",
+		"metrics":        []string{"sum", "value_count"},
+		"default_metric": "value_count",
+	})
+	return map[string]interface{}{
+		"dynamic_templates": []map[string]interface{}{{
+			"strings_as_keyword": map[string]interface{}{
+				"match_mapping_type": "string",
+				"mapping":            map[string]interface{}{"type": "keyword", "ignore_above": 1024},
+			},
+		}},
+		"properties": properties,
+	}
+}
+
+// setMapping adds mapping for the dotted field to properties, creating intermediate objects.
+func setMapping(properties map[string]interface{}, field string, mapping map[string]interface{}) {
+	parts := strings.Split(field, ".")
+	for _, part := range parts[:len(parts)-1] {
+		obj, ok := properties[part].(map[string]interface{})
+		if !ok {
+			obj = map[string]interface{}{"properties": map[string]interface{}{}}
+			properties[part] = obj
+		}
+		properties = obj["properties"].(map[string]interface{})
+	}
+	properties[parts[len(parts)-1]] = mapping
+}
+
+// installTemplate installs a composable index template for targetIndex, along with its lifecycle policy when
+// a retention is configured.
+func installTemplate(ctx context.Context, es *esv8.Client, cfg templateConfig, targetIndex string) error {
+	settings := map[string]interface{}{}
+	if cfg.Retention != "" {
+		policy := map[string]interface{}{
+			"policy": map[string]interface{}{
+				"phases": map[string]interface{}{
+					"hot": map[string]interface{}{
+						"actions": map[string]interface{}{
+							"rollover": map[string]interface{}{
+								"max_age":                cfg.RolloverMaxAge,
+								"max_primary_shard_size": cfg.RolloverMaxPrimaryShardSize,
+							},
+						},
+					},
+					"delete": map[string]interface{}{
+						"min_age": cfg.Retention,
+						"actions": map[string]interface{}{
+							"delete": map[string]interface{}{},
+						},
+					},
+				},
+			},
+		}
+		rsp, err := es.ILM.PutLifecycle(cfg.ILMPolicy,
+			es.ILM.PutLifecycle.WithContext(ctx),
+			es.ILM.PutLifecycle.WithBody(esutil.NewJSONReader(policy)),
+		)
+		if err != nil {
+			return fmt.Errorf("while installing lifecycle policy: %w", err)
+		}
+		rsp.Body.Close()
+		if rsp.IsError() {
+			return fmt.Errorf("while installing lifecycle policy: %s", rsp.String())
+		}
+		settings["index.lifecycle.name"] = cfg.ILMPolicy
+	}
+
+	mappings := rollupMappings(cfg.TSDS)
+	if cfg.TSDS {
+		var dimensions []string
+		for _, field := range metricize.KeyFields() {
+			if field != "transaction.root" {
+				dimensions = append(dimensions, field)
+			}
+		}
+		settings["index.mode"] = "time_series"
+		settings["index.routing_path"] = dimensions
+	}
+	template := map[string]interface{}{
+		"index_patterns": []string{targetIndex},
+		"data_stream":    map[string]interface{}{},
+		"priority":       templatePriority,
+		"template": map[string]interface{}{
+			"settings": settings,
+			"mappings": mappings,
+		},
+		"_meta": map[string]interface{}{
+			"managed_by": "metricize",
+		},
+	}
+	rsp, err := es.Indices.PutIndexTemplate("metricize-"+targetIndex, esutil.NewJSONReader(template),
+		es.Indices.PutIndexTemplate.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("while installing index template: %w", err)
+	}
+	rsp.Body.Close()
+	if rsp.IsError() {
+		return fmt.Errorf("while installing index template: %s", rsp.String())
+	}
+	return nil
+}
+
+// verifyTemplate checks that targetIndex maps the duration histogram as a histogram, either in its existing
+// backing indices or in the templates a new backing index would be created from.
+func verifyTemplate(ctx context.Context, es *esv8.Client, targetIndex string) error {
+	rsp, err := es.Indices.GetFieldMapping([]string{durationHistogramField},
+		es.Indices.GetFieldMapping.WithContext(ctx),
+		es.Indices.GetFieldMapping.WithIndex(targetIndex),
+		es.Indices.GetFieldMapping.WithIgnoreUnavailable(true),
+		es.Indices.GetFieldMapping.WithAllowNoIndices(true),
+	)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.IsError() && rsp.StatusCode != http.StatusNotFound {
+		return errors.New(rsp.String())
+	}
+	var fieldMappings map[string]struct {
+		Mappings map[string]struct {
+			Mapping map[string]struct {
+				Type string `json:"type"`
+			} `json:"mapping"`
+		} `json:"mappings"`
+	}
+	if rsp.StatusCode != http.StatusNotFound {
+		if err := json.NewDecoder(rsp.Body).Decode(&fieldMappings); err != nil {
+			return err
+		}
+	}
+	var mapped bool
+	for index, m := range fieldMappings {
+		for _, fm := range m.Mappings[durationHistogramField].Mapping {
+			if fm.Type != "histogram" {
+				return fmt.Errorf("%s maps %s as %s rather than histogram", index, durationHistogramField, fm.Type)
+			}
+			mapped = true
+		}
+	}
+	if mapped {
+		return nil
+	}
+
+	// no existing mapping, check what a new backing index would get
+	rsp, err = es.Indices.SimulateIndexTemplate(targetIndex, es.Indices.SimulateIndexTemplate.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("no index template matches %s, use -template %s to install one", targetIndex, templateInstall)
+	}
+	if rsp.IsError() {
+		return errors.New(rsp.String())
+	}
+	var simulated struct {
+		Template struct {
+			Mappings map[string]interface{} `json:"mappings"`
+		} `json:"template"`
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(&simulated); err != nil {
+		return err
+	}
+	mapping := simulated.Template.Mappings
+	for _, part := range strings.Split(durationHistogramField, ".") {
+		properties, _ := mapping["properties"].(map[string]interface{})
+		mapping, _ = properties[part].(map[string]interface{})
+	}
+	if t, _ := mapping["type"].(string); t != "histogram" {
+		return fmt.Errorf("index templates matching %s do not map %s as histogram, use -template %s to install one",
+			targetIndex, durationHistogramField, templateInstall)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/graphaelli/metricize"
+)
+
+// fieldMapping returns the mapping of the dotted field in mappings.
+func fieldMapping(mappings map[string]interface{}, field string) map[string]interface{} {
+	m := mappings
+	for _, part := range strings.Split(field, ".") {
+		properties, _ := m["properties"].(map[string]interface{})
+		m, _ = properties[part].(map[string]interface{})
+	}
+	return m
+}
+
+func TestRollupMappings(t *testing.T) {
+	mappings := rollupMappings(false)
+	require.Equal(t, map[string]interface{}{"type": "histogram"}, fieldMapping(mappings, durationHistogramField))
+	require.Equal(t, map[string]interface{}{"type": "boolean"}, fieldMapping(mappings, "transaction.root"))
+	require.Equal(t, map[string]interface{}{"type": "keyword", "ignore_above": 1024}, fieldMapping(mappings, "service.name"))
+	require.Equal(t, map[string]interface{}{
+		"type":           "aggregate_metric_double",
+		"metrics":        []string{"sum", "value_count"},
+		"default_metric": "value_count",
+	}, fieldMapping(mappings, durationSummaryField))
+}
+
+func TestRollupMappingsTSDS(t *testing.T) {
+	mappings := rollupMappings(true)
+	for _, field := range metricize.KeyFields() {
+		require.Equal(t, map[string]interface{}{"type": "keyword", "time_series_dimension": true}, fieldMapping(mappings, field), field)
+	}
+}
+
+func TestTemplateConfigValidate(t *testing.T) {
+	valid := templateConfig{Setup: templateInstall, Retention: "90d", RolloverMaxAge: "30d", RolloverMaxPrimaryShardSize: "50gb"}
+	require.NoError(t, valid.validate())
+	for name, invalid := range map[string]func(c *templateConfig){
+		"retention":               func(c *templateConfig) { c.Retention = "90" },
+		"rollover max age":        func(c *templateConfig) { c.RolloverMaxAge = "30gb" },
+		"rollover max shard size": func(c *templateConfig) { c.RolloverMaxPrimaryShardSize = "gb" },
+	} {
+		c := valid
+		invalid(&c)
+		require.Error(t, c.validate(), name)
+	}
+}
@@ -0,0 +1,196 @@
+package metricize
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPercentiles are the duration percentiles written when a CSVExporter or ParquetExporter sets none.
+var DefaultPercentiles = []float64{50, 90, 95, 99}
+
+// CSVExporter writes rollup documents as CSV, with a header and a row per document holding its timestamp,
+// aggregation key fields, transaction count and duration statistics in microseconds.
+type CSVExporter struct {
+	// Percentiles are the duration percentiles written, defaults to DefaultPercentiles.
+	Percentiles []float64
+}
+
+// Write writes docs to w, ordered by timestamp and then aggregation key.
+// Duration statistics of documents without any transactions are left empty.
+func (e *CSVExporter) Write(w io.Writer, docs []MetricDoc) error {
+	cw := e.NewWriter(w)
+	if err := cw.Write(docs); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// NewWriter returns a CSVWriter writing to w, for writing documents a batch at a time as they are rolled up.
+func (e *CSVExporter) NewWriter(w io.Writer) *CSVWriter {
+	percentiles := e.Percentiles
+	if len(percentiles) == 0 {
+		percentiles = DefaultPercentiles
+	}
+	header := append([]string{"@timestamp"}, keyFields...)
+	header = append(header, "count", "duration_sum_us", "duration_min_us", "duration_max_us")
+	for _, p := range percentiles {
+		header = append(header, percentileColumn(p))
+	}
+	return &CSVWriter{w: csv.NewWriter(w), percentiles: percentiles, header: header}
+}
+
+// CSVWriter writes rollup documents as CSV a batch at a time, see CSVExporter.
+type CSVWriter struct {
+	w           *csv.Writer
+	percentiles []float64
+	header      []string
+	wroteHeader bool
+}
+
+func (w *CSVWriter) writeHeader() error {
+	if w.wroteHeader {
+		return nil
+	}
+	w.wroteHeader = true
+	return w.w.Write(w.header)
+}
+
+// Write writes docs, ordered by timestamp and then aggregation key, preceded by the header on the first call.
+// Duration statistics of documents without any transactions are left empty.
+func (w *CSVWriter) Write(docs []MetricDoc) error {
+	rows, err := tabularRowsOf(docs)
+	if err != nil {
+		return err
+	}
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	record := make([]string, len(w.header))
+	for _, row := range rows {
+		record = record[:0]
+		record = append(record, row.doc.Timestamp.UTC().Format(time.RFC3339))
+		for _, field := range keyFields {
+			if value, ok := row.fields[field]; ok {
+				record = append(record, fmt.Sprint(value))
+			} else {
+				record = append(record, "")
+			}
+		}
+		s := row.stats
+		record = append(record, strconv.FormatInt(s.count, 10), strconv.FormatInt(s.sum, 10))
+		if s.count == 0 {
+			for i := 0; i < 2+len(w.percentiles); i++ {
+				record = append(record, "")
+			}
+		} else {
+			record = append(record, strconv.FormatInt(s.min, 10), strconv.FormatInt(s.max, 10))
+			for _, p := range w.percentiles {
+				record = append(record, strconv.FormatInt(s.percentile(p), 10))
+			}
+		}
+		if err := w.w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// Close writes the header when no documents were written, leaving the underlying writer open.
+func (w *CSVWriter) Close() error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// percentileColumn names the column holding the p-th duration percentile, such as duration_p99_us.
+func percentileColumn(p float64) string {
+	return "duration_p" + strings.ReplaceAll(strconv.FormatFloat(p, 'f', -1, 64), ".", "_") + "_us"
+}
+
+// tabularRow is a document, its aggregation key fields and duration statistics, ready to be written as a row.
+type tabularRow struct {
+	doc    *MetricDoc
+	key    string
+	fields map[string]interface{}
+	stats  durationStats
+}
+
+// tabularRowsOf returns the rows of docs, ordered by timestamp and then aggregation key.
+func tabularRowsOf(docs []MetricDoc) ([]tabularRow, error) {
+	rows := make([]tabularRow, len(docs))
+	for i := range docs {
+		fields, err := docs[i].Fields(keyFields...)
+		if err != nil {
+			return nil, err
+		}
+		key := make([]string, len(keyFields))
+		for j, field := range keyFields {
+			if value, ok := fields[field]; ok {
+				key[j] = fmt.Sprint(value)
+			}
+		}
+		rows[i] = tabularRow{
+			doc:    &docs[i],
+			key:    strings.Join(key, "\x00"),
+			fields: fields,
+			stats:  durationStatsOf(docs[i].Transaction.DurationHistogram),
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		if ti, tj := rows[i].doc.Timestamp, rows[j].doc.Timestamp; !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return rows[i].key < rows[j].key
+	})
+	return rows, nil
+}
+
+// durationStats summarizes a duration histogram, in microseconds.
+type durationStats struct {
+	count, sum, min, max int64
+	// values and counts are the non-empty buckets, in increasing order of value
+	values, counts []int64
+}
+
+func durationStatsOf(dh DurationHistogram) durationStats {
+	var s durationStats
+	order := make([]int, 0, len(dh.Values))
+	for i := range dh.Values {
+		if dh.Counts[i] > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return dh.Values[order[i]] < dh.Values[order[j]] })
+	for _, i := range order {
+		s.values = append(s.values, dh.Values[i])
+		s.counts = append(s.counts, dh.Counts[i])
+		s.count += dh.Counts[i]
+		s.sum += dh.Values[i] * dh.Counts[i]
+	}
+	if len(s.values) > 0 {
+		s.min, s.max = s.values[0], s.values[len(s.values)-1]
+	}
+	return s
+}
+
+// percentile returns the smallest value at or below which p percent of the values lie, 0 without any.
+func (s *durationStats) percentile(p float64) int64 {
+	rank := int64(math.Ceil(p / 100 * float64(s.count)))
+	var cumulative int64
+	for i, count := range s.counts {
+		cumulative += count
+		if cumulative >= rank {
+			return s.values[i]
+		}
+	}
+	return s.max
+}
@@ -0,0 +1,121 @@
+package metricize
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func tabularTestDocs() []MetricDoc {
+	doc := func(ts int64, service string, counts, values []int64) MetricDoc {
+		doc := MetricDoc{Timestamp: time.Unix(ts, 0)}
+		doc.Service.Name = service
+		doc.Transaction.Name = "GET /"
+		doc.Transaction.Root = service == "a"
+		doc.DurationHistogram = DurationHistogram{Counts: counts, Values: values}
+		return doc
+	}
+	return []MetricDoc{
+		doc(1200, "b", nil, nil),
+		doc(1200, "a", []int64{4, 0}, []int64{20000, 30000}),
+		doc(600, "a", []int64{1, 8, 1}, []int64{2000000, 100, 5000}),
+	}
+}
+
+func TestCSVExporter(t *testing.T) {
+	var buf bytes.Buffer
+	e := CSVExporter{Percentiles: []float64{50, 99.9}}
+	require.NoError(t, e.Write(&buf, tabularTestDocs()))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 4)
+	header := strings.Split(lines[0], ",")
+	require.Equal(t, "@timestamp", header[0])
+	require.Equal(t, keyFields, header[1:len(keyFields)+1])
+	require.Equal(t, []string{
+		"count", "duration_sum_us", "duration_min_us", "duration_max_us", "duration_p50_us", "duration_p99_9_us",
+	}, header[len(keyFields)+1:])
+
+	row := func(line string) map[string]string {
+		values := strings.Split(line, ",")
+		require.Len(t, values, len(header))
+		m := make(map[string]string)
+		for i, v := range values {
+			if v != "" {
+				m[header[i]] = v
+			}
+		}
+		return m
+	}
+	require.Equal(t, map[string]string{
+		"@timestamp":        "1970-01-01T00:10:00Z",
+		"service.name":      "a",
+		"transaction.name":  "GET /",
+		"transaction.root":  "true",
+		"count":             "10",
+		"duration_sum_us":   "2005800",
+		"duration_min_us":   "100",
+		"duration_max_us":   "2000000",
+		"duration_p50_us":   "100",
+		"duration_p99_9_us": "2000000",
+	}, row(lines[1]))
+	require.Equal(t, map[string]string{
+		"@timestamp":        "1970-01-01T00:20:00Z",
+		"service.name":      "a",
+		"transaction.name":  "GET /",
+		"transaction.root":  "true",
+		"count":             "4",
+		"duration_sum_us":   "80000",
+		"duration_min_us":   "20000",
+		"duration_max_us":   "20000",
+		"duration_p50_us":   "20000",
+		"duration_p99_9_us": "20000",
+	}, row(lines[2]))
+	require.Equal(t, map[string]string{
+		"@timestamp":       "1970-01-01T00:20:00Z",
+		"service.name":     "b",
+		"transaction.name": "GET /",
+		"count":            "0",
+		"duration_sum_us":  "0",
+	}, row(lines[3]))
+}
+
+func TestDurationStatsPercentile(t *testing.T) {
+	s := durationStatsOf(DurationHistogram{Counts: []int64{5, 0, 4, 1}, Values: []int64{300, 50, 100, 200}})
+	require.Equal(t, []int64{100, 200, 300}, s.values)
+	require.Equal(t, int64(10), s.count)
+	require.Equal(t, int64(100), s.min)
+	require.Equal(t, int64(300), s.max)
+	for p, want := range map[float64]int64{1: 100, 40: 100, 41: 200, 50: 200, 51: 300, 100: 300} {
+		require.Equal(t, want, s.percentile(p), "p%g", p)
+	}
+}
+
+func TestCSVWriterBatches(t *testing.T) {
+	var buf bytes.Buffer
+	w := (&CSVExporter{}).NewWriter(&buf)
+	docs := tabularTestDocs()
+	require.NoError(t, w.Write(docs[:1]))
+	require.NoError(t, w.Write(docs[1:]))
+	require.NoError(t, w.Close())
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	// a single header, each batch ordered on its own
+	require.Len(t, lines, 4)
+	require.True(t, strings.HasPrefix(lines[0], "@timestamp,"))
+	for i, prefix := range []string{"1970-01-01T00:20:00Z,", "1970-01-01T00:10:00Z,", "1970-01-01T00:20:00Z,"} {
+		require.True(t, strings.HasPrefix(lines[i+1], prefix), lines[i+1])
+	}
+	require.Contains(t, lines[1], ",b,")
+	require.Contains(t, lines[3], ",a,")
+}
+
+func TestCSVWriterEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, (&CSVExporter{}).NewWriter(&buf).Close())
+	require.Equal(t, 1, strings.Count(buf.String(), "\n"))
+	require.True(t, strings.HasPrefix(buf.String(), "@timestamp,"))
+}
@@ -0,0 +1,72 @@
+package metricize
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DataStream identifies a data stream following the {type}-{dataset}-{namespace} naming scheme.
+type DataStream struct {
+	Type      string `json:"type,omitempty"`
+	Dataset   string `json:"dataset,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// String returns the data stream name.
+func (d DataStream) String() string {
+	return d.Type + "-" + d.Dataset + "-" + d.Namespace
+}
+
+// Validate checks d against the data stream naming scheme and index naming rules.
+func (d DataStream) Validate() error {
+	for _, part := range []struct {
+		name, value string
+		maxLen      int
+	}{
+		{"type", d.Type, 100},
+		{"dataset", d.Dataset, 100},
+		{"namespace", d.Namespace, 100},
+	} {
+		switch {
+		case part.value == "":
+			return fmt.Errorf("data stream %s must not be empty", part.name)
+		case len(part.value) > part.maxLen:
+			return fmt.Errorf("data stream %s %q is longer than %d bytes", part.name, part.value, part.maxLen)
+		case strings.Contains(part.value, "-"):
+			return fmt.Errorf("data stream %s %q must not contain '-'", part.name, part.value)
+		}
+	}
+	name := d.String()
+	switch {
+	case len(name) > 255:
+		return fmt.Errorf("data stream name %q is longer than 255 bytes", name)
+	case strings.ToLower(name) != name:
+		return fmt.Errorf("data stream name %q must be lowercase", name)
+	case strings.ContainsAny(name, `\/*?"<>| ,#:`):
+		return fmt.Errorf(`data stream name %q must not contain any of \/*?"<>| ,#: or spaces`, name)
+	case strings.ContainsAny(name[:1], "_+."):
+		return errors.New("data stream name must not start with '_', '+' or '.'")
+	}
+	return nil
+}
+
+// FormatInterval formats d using its largest whole unit, such as 10m, 1h or 1d, rather than time.Duration's 1h0m0s.
+func FormatInterval(d time.Duration) string {
+	for _, unit := range []struct {
+		suffix string
+		d      time.Duration
+	}{
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+		{"ms", time.Millisecond},
+	} {
+		if d >= unit.d && d%unit.d == 0 {
+			return fmt.Sprintf("%d%s", d/unit.d, unit.suffix)
+		}
+	}
+	return d.String()
+}
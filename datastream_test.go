@@ -0,0 +1,40 @@
+package metricize
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataStreamValidate(t *testing.T) {
+	valid := DataStream{Type: "metrics", Dataset: "apm.transaction_rollup.10m", Namespace: "default"}
+	require.NoError(t, valid.Validate())
+	require.Equal(t, "metrics-apm.transaction_rollup.10m-default", valid.String())
+
+	for name, ds := range map[string]DataStream{
+		"empty namespace":   {Type: "metrics", Dataset: "apm"},
+		"hyphenated":        {Type: "metrics", Dataset: "apm-rollup", Namespace: "default"},
+		"uppercase":         {Type: "metrics", Dataset: "APM", Namespace: "default"},
+		"invalid character": {Type: "metrics", Dataset: "apm", Namespace: "a:b"},
+		"leading dot":       {Type: ".metrics", Dataset: "apm", Namespace: "default"},
+		"long dataset":      {Type: "metrics", Dataset: strings.Repeat("a", 101), Namespace: "default"},
+	} {
+		require.Error(t, ds.Validate(), name)
+	}
+}
+
+func TestFormatInterval(t *testing.T) {
+	for d, expected := range map[time.Duration]string{
+		time.Minute:             "1m",
+		10 * time.Minute:        "10m",
+		90 * time.Minute:        "90m",
+		time.Hour:               "1h",
+		24 * time.Hour:          "1d",
+		30 * time.Second:        "30s",
+		1500 * time.Millisecond: "1500ms",
+	} {
+		require.Equal(t, expected, FormatInterval(d))
+	}
+}
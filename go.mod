@@ -1,12 +1,18 @@
 module github.com/graphaelli/metricize
 
-go 1.18
+// go 1.22 is the minimum of github.com/klauspost/compress, the zstd decoder of NDJSON inputs
+go 1.22
 
 require (
 	github.com/cespare/xxhash/v2 v2.2.0
 	github.com/elastic/apm-server v0.0.0-20221206053257-631667a92e96
+	github.com/elastic/elastic-transport-go/v8 v8.1.0
+	github.com/elastic/go-elasticsearch/v8 v8.5.0
 	github.com/elastic/go-hdrhistogram v0.1.0
+	github.com/klauspost/compress v1.18.0
 	github.com/stretchr/testify v1.8.1
+	go.opentelemetry.io/proto/otlp v0.19.0
+	google.golang.org/protobuf v1.28.1
 )
 
 require (
@@ -15,8 +21,6 @@ require (
 	github.com/elastic/beats/v7 v7.0.0-alpha2.0.20221205204510-74edd05ef458 // indirect
 	github.com/elastic/elastic-agent-client/v7 v7.0.2 // indirect
 	github.com/elastic/elastic-agent-libs v0.2.15 // indirect
-	github.com/elastic/elastic-transport-go/v8 v8.1.0 // indirect
-	github.com/elastic/go-elasticsearch/v8 v8.5.0 // indirect
 	github.com/elastic/go-licenser v0.4.1 // indirect
 	github.com/elastic/go-sysinfo v1.9.0 // indirect
 	github.com/elastic/go-ucfg v0.8.6 // indirect
@@ -49,7 +53,6 @@ require (
 	golang.org/x/tools v0.3.0 // indirect
 	google.golang.org/genproto v0.0.0-20221205194025-8222ab48f5fc // indirect
 	google.golang.org/grpc v1.51.0 // indirect
-	google.golang.org/protobuf v1.28.1 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 	howett.net/plist v1.0.0 // indirect
@@ -1,6 +1,8 @@
 package metricize
 
 import (
+	"encoding/json"
+	"strings"
 	"time"
 )
 
@@ -9,12 +11,34 @@ type DurationHistogram struct {
 	Values []int64 `json:"values"`
 }
 
+// DurationSummary is the sum and count of transaction durations, in microseconds.
+type DurationSummary struct {
+	Sum        float64 `json:"sum"`
+	ValueCount int64   `json:"value_count"`
+}
+
 type Transaction struct {
 	Name              string `json:"name"`
 	Root              bool   `json:"root,omitempty"`
 	Result            string `json:"result,omitempty"`
 	Type              string `json:"type"`
 	DurationHistogram `json:"duration.histogram"`
+	// DurationSummary is set on rollups only.
+	DurationSummary *DurationSummary `json:"duration.summary,omitempty"`
+}
+
+// Observer identifies the APM Server that produced a document.
+type Observer struct {
+	Hostname string `json:"hostname,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Version  string `json:"version,omitempty"`
+}
+
+// Provenance records where a rollup document came from.
+type Provenance struct {
+	SourceIndex string `json:"source_index,omitempty"`
+	Version     string `json:"version,omitempty"`
+	RunID       string `json:"run_id,omitempty"`
 }
 
 type MetricDoc struct {
@@ -64,16 +88,17 @@ type MetricDoc struct {
 			Name string `json:"name,omitempty"`
 		} `json:"pod,omitempty,omitempty"`
 	} `json:"kubernetes,omitempty"`
-	Metricset struct {
-		Name string `json:"name"`
+	DataStream *DataStream `json:"data_stream,omitempty"`
+	Metricset  struct {
+		Name     string `json:"name"`
+		Interval string `json:"interval,omitempty"`
 	} `json:"metricset"`
+	Metricize     *Provenance `json:"metricize,omitempty"`
 	NumericLabels struct {
 		Period int64 `json:"rollup_period"`
 	} `json:"numeric_labels"`
-	Observer struct {
-		Version string `json:"version"`
-	} `json:"observer"`
-	Service struct {
+	Observer Observer `json:"observer"`
+	Service  struct {
 		Environment string `json:"environment,omitempty"`
 		Name        string `json:"name,omitempty"`
 		Node        struct {
@@ -91,3 +116,58 @@ type MetricDoc struct {
 	} `json:"service,omitempty"`
 	Transaction `json:"transaction"`
 }
+
+// MetricDocFromFields builds a MetricDoc from flattened, dotted field names,
+// such as the keys of a composite aggregation bucket.
+// Fields with nil values are ignored.
+func MetricDocFromFields(fields map[string]interface{}) (MetricDoc, error) {
+	root := make(map[string]interface{})
+	for field, value := range fields {
+		if value == nil {
+			continue
+		}
+		parts := strings.Split(field, ".")
+		obj := root
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := obj[part].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				obj[part] = child
+			}
+			obj = child
+		}
+		obj[parts[len(parts)-1]] = value
+	}
+	var doc MetricDoc
+	b, err := json.Marshal(root)
+	if err != nil {
+		return doc, err
+	}
+	err = json.Unmarshal(b, &doc)
+	return doc, err
+}
+
+// Fields returns the values of the named dotted fields of m, omitting empty strings.
+func (m *MetricDoc) Fields(names ...string) (map[string]interface{}, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var root map[string]interface{}
+	if err := json.Unmarshal(b, &root); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		var value interface{} = root
+		for _, part := range strings.Split(name, ".") {
+			obj, _ := value.(map[string]interface{})
+			value = obj[part]
+		}
+		if value == nil || value == "" {
+			continue
+		}
+		fields[name] = value
+	}
+	return fields, nil
+}
@@ -93,7 +93,125 @@ func TestAggregateMetricDocs(t *testing.T) {
 		Counts: []int64{0, 0, 0, 2},
 		Values: []int64{0, 1, 2, 3},
 	}
+	expectedMetricDoc.DurationSummary = &DurationSummary{Sum: 6, ValueCount: 2}
 
 	key := newTransactionAggregationKey(&ms1)
 	require.Equal(t, expectedMetricDoc, a.Emit(key))
 }
+
+func TestMetricDocFromFields(t *testing.T) {
+	doc, err := MetricDocFromFields(map[string]interface{}{
+		"@timestamp":            "2022-12-07T03:15:00.000Z",
+		"service.name":          "frontend",
+		"service.language.name": "javascript",
+		"service.environment":   nil,
+		"transaction.name":      "GET /",
+		"transaction.root":      true,
+	})
+	require.NoError(t, err)
+
+	var expected MetricDoc
+	expected.Timestamp = time.Date(2022, 12, 7, 3, 15, 0, 0, time.UTC)
+	expected.Service.Name = "frontend"
+	expected.Service.Language.Name = "javascript"
+	expected.Transaction.Name = "GET /"
+	expected.Transaction.Root = true
+	require.Equal(t, expected, doc)
+
+	_, err = MetricDocFromFields(map[string]interface{}{"transaction.root": "yes"})
+	require.Error(t, err)
+}
+
+func TestSourceFields(t *testing.T) {
+	doc := []byte(`
+{
+	"@timestamp": "2022-12-07T03:15:00.000Z",
+	"_doc_count": 12,
+	"agent": {"name": "rum-js"},
+	"host": {"name": "h1", "hostname": "h1.example", "os": {"platform": "linux"}},
+	"cloud": {"provider": "gcp", "region": "us-east1", "account": {"id": "a1"}},
+	"container": {"id": "c1"},
+	"event": {"outcome": "success"},
+	"metricset": {"name": "transaction"},
+	"observer": {"version": "8.5.2", "hostname": "apm-1", "type": "apm-server", "id": "o1"},
+	"service": {
+		"name": "elastic-co-frontend",
+		"environment": "production",
+		"node": {"name": "n1"},
+		"language": {"name": "javascript"},
+		"runtime": {"name": "browser", "version": "1"},
+		"version": "1.0.0"
+	},
+	"transaction": {
+		"root": true,
+		"name": "POST /event",
+		"result": "HTTP 2xx",
+		"type": "http-request",
+		"duration.histogram": {"counts": [1], "values": [3]}
+	}
+}`)
+	var full MetricDoc
+	require.NoError(t, json.Unmarshal(doc, &full))
+
+	// mimic _source includes filtering
+	included := make(map[string]bool)
+	for _, field := range SourceFields() {
+		included[field] = true
+	}
+	var filter func(obj map[string]interface{}, prefix string) map[string]interface{}
+	filter = func(obj map[string]interface{}, prefix string) map[string]interface{} {
+		out := make(map[string]interface{})
+		for k, v := range obj {
+			path := prefix + k
+			if included[path] {
+				out[k] = v
+			} else if child, ok := v.(map[string]interface{}); ok {
+				if filtered := filter(child, path+"."); len(filtered) > 0 {
+					out[k] = filtered
+				}
+			}
+		}
+		return out
+	}
+	var source map[string]interface{}
+	require.NoError(t, json.Unmarshal(doc, &source))
+	b, err := json.Marshal(filter(source, ""))
+	require.NoError(t, err)
+	var partial MetricDoc
+	require.NoError(t, json.Unmarshal(b, &partial))
+	require.Equal(t, full.Observer, partial.Observer)
+
+	require.Equal(t, newTransactionAggregationKey(&full), newTransactionAggregationKey(&partial))
+	require.Equal(t, full.Timestamp, partial.Timestamp)
+	require.Equal(t, full.DurationHistogram, partial.DurationHistogram)
+	// the number of transactions summarized is kept
+	require.EqualValues(t, 12, partial.DocCount)
+}
+
+func TestMetricDocFields(t *testing.T) {
+	var doc MetricDoc
+	doc.Service.Name = "svc"
+	doc.Transaction.Root = true
+	fields, err := doc.Fields("service.name", "service.environment", "transaction.root", "no.such.field")
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"service.name": "svc", "transaction.root": true}, fields)
+
+	roundtrip, err := MetricDocFromFields(fields)
+	require.NoError(t, err)
+	require.Equal(t, newTransactionAggregationKey(&doc), newTransactionAggregationKey(&roundtrip))
+}
+
+func TestMetricDocOmitsRollupFields(t *testing.T) {
+	var doc MetricDoc
+	b, err := json.Marshal(&doc)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), `"data_stream"`)
+	require.NotContains(t, string(b), `"metricize"`)
+
+	doc.DataStream = &DataStream{Type: "metrics", Dataset: "apm.internal", Namespace: "rollup10m0s"}
+	doc.Metricize = &Provenance{RunID: "run"}
+	b, err = json.Marshal(&doc)
+	require.NoError(t, err)
+	require.Contains(t, string(b), `"data_stream":{"type":"metrics","dataset":"apm.internal","namespace":"rollup10m0s"}`)
+	require.Contains(t, string(b), `"metricize":{"run_id":"run"}`)
+}
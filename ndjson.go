@@ -0,0 +1,101 @@
+package metricize
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// DecodeDocs reads a stream of JSON values from r, typically one per line, calling fn for each MetricDoc found.
+// A value may be a document itself, a search hit holding the document in _source, a whole search response,
+// or an OTLP/JSON metrics request, such as the OpenTelemetry Collector's file exporter writes, see
+// OTLPMetricDocs.
+// Bulk action lines, such as {"index":{}}, are skipped so that bulk request bodies can be read too.
+// It returns the number of documents decoded, and of cumulative OTLP data points skipped, as only delta
+// temporality data points can be rolled up.
+func DecodeDocs(r io.Reader, fn func(*MetricDoc) error) (n, skipped int, err error) {
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			return n, skipped, nil
+		} else if err != nil {
+			return n, skipped, fmt.Errorf("value %d: %w", line, err)
+		}
+		docs, s, err := docsOf(raw)
+		skipped += s
+		if err != nil {
+			return n, skipped, fmt.Errorf("value %d: %w", line, err)
+		}
+		for i := range docs {
+			if err := fn(&docs[i]); err != nil {
+				return n, skipped, err
+			}
+			n++
+		}
+	}
+}
+
+// bulkActions are the actions that may appear on the action line of a bulk request body.
+var bulkActions = map[string]bool{"index": true, "create": true, "update": true, "delete": true}
+
+// docsOf returns the documents held by the JSON object raw, and the number of cumulative OTLP data points skipped.
+func docsOf(raw json.RawMessage) ([]MetricDoc, int, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+		return nil, 0, fmt.Errorf("expected a JSON object, got %.20s", raw)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, 0, err
+	}
+	if len(fields) == 1 {
+		for action := range fields {
+			if bulkActions[action] {
+				return nil, 0, nil
+			}
+		}
+	}
+	switch {
+	case fields["_source"] != nil:
+		var hit SearchHit
+		if err := json.Unmarshal(raw, &hit); err != nil {
+			return nil, 0, err
+		}
+		return []MetricDoc{hit.Source}, 0, nil
+	case fields["hits"] != nil:
+		var rsp struct {
+			Hits struct {
+				Hits []SearchHit `json:"hits"`
+			} `json:"hits"`
+		}
+		if err := json.Unmarshal(raw, &rsp); err != nil {
+			return nil, 0, err
+		}
+		docs := make([]MetricDoc, len(rsp.Hits.Hits))
+		for i, hit := range rsp.Hits.Hits {
+			docs[i] = hit.Source
+		}
+		return docs, 0, nil
+	case fields["resourceMetrics"] != nil:
+		var m metricspb.MetricsData
+		// fields of later OTLP versions do not matter to the histograms read
+		if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(raw, &m); err != nil {
+			return nil, 0, err
+		}
+		var docs []MetricDoc
+		skipped, err := OTLPMetricDocs(&m, func(doc *MetricDoc) error {
+			docs = append(docs, *doc)
+			return nil
+		})
+		return docs, skipped, err
+	}
+	var doc MetricDoc
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, 0, err
+	}
+	return []MetricDoc{doc}, 0, nil
+}
@@ -0,0 +1,75 @@
+package metricize
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeDocs(t *testing.T) {
+	input := `{"@timestamp": "2022-12-07T03:15:00.000Z", "transaction": {"name": "doc"}}
+{"index": {"_index": "metrics-apm.internal-default"}}
+{"@timestamp": "2022-12-07T03:15:01.000Z", "transaction": {"name": "bulk"}}
+{"_index": "metrics-apm.internal-default", "_id": "1", "_source": {"transaction": {"name": "hit"}}}
+
+{"took": 1, "hits": {"hits": [{"_source": {"transaction": {"name": "rsp1"}}}, {"_source": {"transaction": {"name": "rsp2"}}}]}}
+`
+	var names []string
+	n, skipped, err := DecodeDocs(strings.NewReader(input), func(doc *MetricDoc) error {
+		names = append(names, doc.Transaction.Name)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	require.Zero(t, skipped)
+	require.Equal(t, []string{"doc", "bulk", "hit", "rsp1", "rsp2"}, names)
+}
+
+func TestDecodeDocsInvalid(t *testing.T) {
+	for name, input := range map[string]string{
+		"truncated": `{"transaction": {"name": "doc"}}` + "\n" + `{"transaction": `,
+		"array":     `[{"transaction": {"name": "doc"}}]`,
+	} {
+		_, _, err := DecodeDocs(strings.NewReader(input), func(*MetricDoc) error { return nil })
+		require.Error(t, err, name)
+	}
+}
+
+func TestDecodeDocsOTLP(t *testing.T) {
+	input := `{"resourceMetrics": [{
+	"resource": {"attributes": [
+		{"key": "service.name", "value": {"stringValue": "checkout"}},
+		{"key": "service.version", "value": {"intValue": "3"}},
+		{"key": "transaction.root", "value": {"boolValue": true}}
+	]},
+	"schemaUrl": "https://opentelemetry.io/schemas/1.21.0",
+	"futureField": {},
+	"scopeMetrics": [{"metrics": [
+		{
+			"name": "transaction.duration",
+			"unit": "us",
+			"histogram": {"aggregationTemporality": 1, "dataPoints": [{"count": "1", "bucketCounts": ["1"]}]}
+		},
+		{
+			"name": "transaction.duration",
+			"unit": "us",
+			"histogram": {"aggregationTemporality": 2, "dataPoints": [{"count": "1", "bucketCounts": ["1"]}, {"count": "2", "bucketCounts": ["2"]}]}
+		}
+	]}]
+}]}
+`
+	var docs []MetricDoc
+	n, skipped, err := DecodeDocs(strings.NewReader(input), func(doc *MetricDoc) error {
+		docs = append(docs, *doc)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	// cumulative data points are counted rather than rolled up
+	require.Equal(t, 2, skipped)
+	require.Equal(t, "checkout", docs[0].Service.Name)
+	// attributes not of the type of their field are ignored
+	require.Empty(t, docs[0].Service.Version)
+	require.True(t, docs[0].Transaction.Root)
+}
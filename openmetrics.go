@@ -0,0 +1,142 @@
+package metricize
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultOpenMetricsBuckets are the bucket upper bounds, in seconds, used when an OpenMetricsExporter sets none.
+var DefaultOpenMetricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// OpenMetricsExporter writes rollup documents as an OpenMetrics classic histogram family,
+// with one labelled histogram per aggregation key.
+// Histogram buckets, counts and sums are counters, so the histogram of a document accumulates those of every
+// earlier document sharing its labels: rate() over the samples yields the rollups back.
+type OpenMetricsExporter struct {
+	// Name of the metric family, defaults to transaction_duration_seconds.
+	Name string
+	// Buckets are the upper bounds, in seconds, of the histogram buckets, +Inf is always added.
+	Buckets []float64
+	// Timestamps adds the rollup timestamp to every sample, for backfilling rather than scraping.
+	Timestamps bool
+}
+
+// openMetricsPoint is a single histogram, ready to be written.
+type openMetricsPoint struct {
+	labels    string
+	time      time.Time
+	timestamp string
+	buckets   []int64
+	count     int64
+	// sum is in microseconds, converted when written to avoid accumulating rounding errors
+	sum int64
+}
+
+// Write writes the histograms of docs to w, followed by the # EOF marker.
+// Histograms sharing the same labels are written together in time order, each accumulating the ones before.
+func (e *OpenMetricsExporter) Write(w io.Writer, docs []MetricDoc) error {
+	name := e.Name
+	if name == "" {
+		name = "transaction_duration_seconds"
+	}
+	bounds := e.Buckets
+	if len(bounds) == 0 {
+		bounds = DefaultOpenMetricsBuckets
+	}
+
+	points := make([]openMetricsPoint, len(docs))
+	for i := range docs {
+		labels, err := openMetricsLabels(&docs[i])
+		if err != nil {
+			return err
+		}
+		p := openMetricsPoint{labels: labels, time: docs[i].Timestamp, buckets: make([]int64, len(bounds)+1)}
+		if e.Timestamps {
+			p.timestamp = " " + strconv.FormatFloat(float64(p.time.UnixMilli())/1000, 'f', -1, 64)
+		}
+		dh := docs[i].Transaction.DurationHistogram
+		for j, us := range dh.Values {
+			count := dh.Counts[j]
+			seconds := float64(us) / 1e6
+			p.buckets[sort.SearchFloat64s(bounds, seconds)] += count
+			p.count += count
+			p.sum += us * count
+		}
+		points[i] = p
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		if points[i].labels != points[j].labels {
+			return points[i].labels < points[j].labels
+		}
+		return points[i].time.Before(points[j].time)
+	})
+	for i := 1; i < len(points); i++ {
+		if prev := &points[i-1]; prev.labels == points[i].labels {
+			for j := range points[i].buckets {
+				points[i].buckets[j] += prev.buckets[j]
+			}
+			points[i].count += prev.count
+			points[i].sum += prev.sum
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# TYPE %s histogram\n", name)
+	if strings.HasSuffix(name, "_seconds") {
+		fmt.Fprintf(bw, "# UNIT %s seconds\n", name)
+	}
+	fmt.Fprintf(bw, "# HELP %s Transaction duration rolled up by metricize.\n", name)
+	for _, p := range points {
+		sep := ""
+		if p.labels != "" {
+			sep = ","
+		}
+		var cumulative int64
+		for i, n := range p.buckets {
+			cumulative += n
+			le := "+Inf"
+			if i < len(bounds) {
+				le = formatOpenMetricsFloat(bounds[i])
+			}
+			fmt.Fprintf(bw, "%s_bucket{%s%sle=\"%s\"} %d%s\n", name, p.labels, sep, le, cumulative, p.timestamp)
+		}
+		labels := ""
+		if p.labels != "" {
+			labels = "{" + p.labels + "}"
+		}
+		fmt.Fprintf(bw, "%s_count%s %d%s\n", name, labels, p.count, p.timestamp)
+		fmt.Fprintf(bw, "%s_sum%s %s%s\n", name, labels, formatOpenMetricsFloat(float64(p.sum)/1e6), p.timestamp)
+	}
+	fmt.Fprint(bw, "# EOF\n")
+	return bw.Flush()
+}
+
+// openMetricsLabels formats the aggregation key fields of doc as sorted OpenMetrics labels, such as
+// service_name="a",transaction_name="GET /".
+func openMetricsLabels(doc *MetricDoc) (string, error) {
+	fields, err := doc.Fields(keyFields...)
+	if err != nil {
+		return "", err
+	}
+	labels := make([]string, 0, len(fields))
+	for field, value := range fields {
+		labels = append(labels, strings.ReplaceAll(field, ".", "_")+"="+escapeOpenMetricsLabel(fmt.Sprint(value)))
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ","), nil
+}
+
+var openMetricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeOpenMetricsLabel(v string) string {
+	return `"` + openMetricsLabelEscaper.Replace(v) + `"`
+}
+
+func formatOpenMetricsFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,72 @@
+package metricize
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenMetricsExporter(t *testing.T) {
+	doc := func(ts int64, service string, counts, values []int64) MetricDoc {
+		doc := MetricDoc{Timestamp: time.Unix(ts, 0)}
+		doc.Service.Name = service
+		doc.Transaction.Name = `GET "/"`
+		doc.DurationHistogram = DurationHistogram{Counts: counts, Values: values}
+		return doc
+	}
+	docs := []MetricDoc{
+		doc(1200, "b", []int64{1}, []int64{100}),
+		doc(1200, "a", []int64{4}, []int64{20000}),
+		doc(600, "a", []int64{2, 1}, []int64{5000, 2000000}),
+	}
+
+	var buf bytes.Buffer
+	e := OpenMetricsExporter{Buckets: []float64{0.01, 1}, Timestamps: true}
+	require.NoError(t, e.Write(&buf, docs))
+	require.Equal(t, `# TYPE transaction_duration_seconds histogram
+# UNIT transaction_duration_seconds seconds
+# HELP transaction_duration_seconds Transaction duration rolled up by metricize.
+transaction_duration_seconds_bucket{service_name="a",transaction_name="GET \"/\"",le="0.01"} 2 600
+transaction_duration_seconds_bucket{service_name="a",transaction_name="GET \"/\"",le="1"} 2 600
+transaction_duration_seconds_bucket{service_name="a",transaction_name="GET \"/\"",le="+Inf"} 3 600
+transaction_duration_seconds_count{service_name="a",transaction_name="GET \"/\""} 3 600
+transaction_duration_seconds_sum{service_name="a",transaction_name="GET \"/\""} 2.01 600
+transaction_duration_seconds_bucket{service_name="a",transaction_name="GET \"/\"",le="0.01"} 2 1200
+transaction_duration_seconds_bucket{service_name="a",transaction_name="GET \"/\"",le="1"} 6 1200
+transaction_duration_seconds_bucket{service_name="a",transaction_name="GET \"/\"",le="+Inf"} 7 1200
+transaction_duration_seconds_count{service_name="a",transaction_name="GET \"/\""} 7 1200
+transaction_duration_seconds_sum{service_name="a",transaction_name="GET \"/\""} 2.09 1200
+transaction_duration_seconds_bucket{service_name="b",transaction_name="GET \"/\"",le="0.01"} 1 1200
+transaction_duration_seconds_bucket{service_name="b",transaction_name="GET \"/\"",le="1"} 1 1200
+transaction_duration_seconds_bucket{service_name="b",transaction_name="GET \"/\"",le="+Inf"} 1 1200
+transaction_duration_seconds_count{service_name="b",transaction_name="GET \"/\""} 1 1200
+transaction_duration_seconds_sum{service_name="b",transaction_name="GET \"/\""} 0.0001 1200
+# EOF
+`, buf.String())
+}
+
+func TestOpenMetricsExporterDefaults(t *testing.T) {
+	var buf bytes.Buffer
+	e := OpenMetricsExporter{Name: "latency"}
+	require.NoError(t, e.Write(&buf, []MetricDoc{{}}))
+	require.Equal(t, `# TYPE latency histogram
+# HELP latency Transaction duration rolled up by metricize.
+latency_bucket{le="0.005"} 0
+latency_bucket{le="0.01"} 0
+latency_bucket{le="0.025"} 0
+latency_bucket{le="0.05"} 0
+latency_bucket{le="0.1"} 0
+latency_bucket{le="0.25"} 0
+latency_bucket{le="0.5"} 0
+latency_bucket{le="1"} 0
+latency_bucket{le="2.5"} 0
+latency_bucket{le="5"} 0
+latency_bucket{le="10"} 0
+latency_bucket{le="+Inf"} 0
+latency_count 0
+latency_sum 0
+# EOF
+`, buf.String())
+}
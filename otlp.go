@@ -0,0 +1,290 @@
+package metricize
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+// otlpResourceAttributes maps aggregation key fields describing the monitored entity to OpenTelemetry resource
+// attributes. Key fields not listed here become data point attributes, keeping their name.
+var otlpResourceAttributes = map[string]string{
+	"agent.name":               "telemetry.sdk.name",
+	"service.name":             "service.name",
+	"service.version":          "service.version",
+	"service.environment":      "deployment.environment",
+	"service.node.name":        "service.instance.id",
+	"service.language.name":    "telemetry.sdk.language",
+	"service.language.version": "service.language.version",
+	"service.runtime.name":     "process.runtime.name",
+	"service.runtime.version":  "process.runtime.version",
+	"host.name":                "host.name",
+	"host.hostname":            "host.hostname",
+	"host.os.platform":         "os.type",
+	"cloud.provider":           "cloud.provider",
+	"cloud.region":             "cloud.region",
+	"cloud.availability_zone":  "cloud.availability_zone",
+	"cloud.account.id":         "cloud.account.id",
+	"cloud.account.name":       "cloud.account.name",
+	"cloud.machine.type":       "host.type",
+	"cloud.project.id":         "cloud.project.id",
+	"cloud.project.name":       "cloud.project.name",
+	"container.id":             "container.id",
+	"kubernetes.pod.name":      "k8s.pod.name",
+}
+
+// OTLPExporter converts rollup documents into OTLP histogram metrics.
+type OTLPExporter struct {
+	// Exponential selects exponential histograms rather than explicit bucket histograms.
+	Exponential bool
+	// Buckets are the explicit bucket upper bounds in seconds, defaults to DefaultOpenMetricsBuckets.
+	Buckets []float64
+	// MaxBuckets limits the number of exponential histogram buckets, defaults to 160.
+	MaxBuckets int
+	// Scope identifies the instrumentation scope, such as metricize and its version.
+	Scope *commonpb.InstrumentationScope
+}
+
+// Metrics converts docs into metrics holding a transaction.duration data point per document, grouped by
+// resource. Each data point covers the rollup period, taken from numeric_labels.rollup_period.
+// MetricsData shares its fields, and so its encodings, with the ExportMetricsServiceRequest of OTLP exporters,
+// without depending on gRPC.
+func (e *OTLPExporter) Metrics(docs []MetricDoc) (*metricspb.MetricsData, error) {
+	type resource struct {
+		attrs []*commonpb.KeyValue
+		docs  []int
+	}
+	resources := make(map[string]*resource)
+	pointAttrs := make([][]*commonpb.KeyValue, len(docs))
+	for i := range docs {
+		fields, err := docs[i].Fields(keyFields...)
+		if err != nil {
+			return nil, err
+		}
+		var resAttrs []*commonpb.KeyValue
+		for field, value := range fields {
+			if attr, ok := otlpResourceAttributes[field]; ok {
+				resAttrs = append(resAttrs, otlpKeyValue(attr, value))
+			} else {
+				pointAttrs[i] = append(pointAttrs[i], otlpKeyValue(field, value))
+			}
+		}
+		sortOTLPAttributes(resAttrs)
+		sortOTLPAttributes(pointAttrs[i])
+		id := otlpAttributesKey(resAttrs)
+		r, ok := resources[id]
+		if !ok {
+			r = &resource{attrs: resAttrs}
+			resources[id] = r
+		}
+		r.docs = append(r.docs, i)
+	}
+
+	ids := make([]string, 0, len(resources))
+	for id := range resources {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	m := &metricspb.MetricsData{}
+	for _, id := range ids {
+		r := resources[id]
+		sort.SliceStable(r.docs, func(i, j int) bool {
+			a, b := otlpAttributesKey(pointAttrs[r.docs[i]]), otlpAttributesKey(pointAttrs[r.docs[j]])
+			if a != b {
+				return a < b
+			}
+			return docs[r.docs[i]].Timestamp.Before(docs[r.docs[j]].Timestamp)
+		})
+		metric := &metricspb.Metric{
+			Name:        "transaction.duration",
+			Description: "Transaction duration rolled up by metricize.",
+			Unit:        "s",
+		}
+		if e.Exponential {
+			h := &metricspb.ExponentialHistogram{AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA}
+			for _, i := range r.docs {
+				dp := e.exponentialDataPoint(&docs[i])
+				dp.Attributes = pointAttrs[i]
+				h.DataPoints = append(h.DataPoints, dp)
+			}
+			metric.Data = &metricspb.Metric_ExponentialHistogram{ExponentialHistogram: h}
+		} else {
+			h := &metricspb.Histogram{AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA}
+			for _, i := range r.docs {
+				dp := e.explicitDataPoint(&docs[i])
+				dp.Attributes = pointAttrs[i]
+				h.DataPoints = append(h.DataPoints, dp)
+			}
+			metric.Data = &metricspb.Metric_Histogram{Histogram: h}
+		}
+		m.ResourceMetrics = append(m.ResourceMetrics, &metricspb.ResourceMetrics{
+			Resource:     &resourcepb.Resource{Attributes: r.attrs},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{Scope: e.Scope, Metrics: []*metricspb.Metric{metric}}},
+		})
+	}
+	return m, nil
+}
+
+// otlpStats holds what both histogram representations share.
+type otlpStats struct {
+	start, end    uint64
+	count         uint64
+	sum, min, max *float64
+	seconds       []float64
+	counts        []int64
+}
+
+func otlpStatsOf(doc *MetricDoc) otlpStats {
+	s := otlpStats{
+		start: uint64(doc.Timestamp.UnixNano()),
+		end:   uint64(doc.Timestamp.Add(time.Duration(doc.NumericLabels.Period) * time.Second).UnixNano()),
+	}
+	dh := doc.Transaction.DurationHistogram
+	var sumMicros int64
+	for i, us := range dh.Values {
+		count := dh.Counts[i]
+		if count <= 0 {
+			continue
+		}
+		seconds := float64(us) / 1e6
+		if s.min == nil || seconds < *s.min {
+			s.min = &seconds
+		}
+		if s.max == nil || seconds > *s.max {
+			s.max = &seconds
+		}
+		s.seconds = append(s.seconds, seconds)
+		s.counts = append(s.counts, count)
+		s.count += uint64(count)
+		sumMicros += us * count
+	}
+	sum := float64(sumMicros) / 1e6
+	s.sum = &sum
+	return s
+}
+
+func (e *OTLPExporter) explicitDataPoint(doc *MetricDoc) *metricspb.HistogramDataPoint {
+	bounds := e.Buckets
+	if len(bounds) == 0 {
+		bounds = DefaultOpenMetricsBuckets
+	}
+	s := otlpStatsOf(doc)
+	dp := &metricspb.HistogramDataPoint{
+		StartTimeUnixNano: s.start,
+		TimeUnixNano:      s.end,
+		Count:             s.count,
+		Sum:               s.sum,
+		BucketCounts:      make([]uint64, len(bounds)+1),
+		ExplicitBounds:    bounds,
+		Min:               s.min,
+		Max:               s.max,
+	}
+	for i, seconds := range s.seconds {
+		dp.BucketCounts[sort.SearchFloat64s(bounds, seconds)] += uint64(s.counts[i])
+	}
+	return dp
+}
+
+// maxOTLPScale is the scale exponential histograms start from before being reduced to fit MaxBuckets.
+const maxOTLPScale = 20
+
+func (e *OTLPExporter) exponentialDataPoint(doc *MetricDoc) *metricspb.ExponentialHistogramDataPoint {
+	maxBuckets := e.MaxBuckets
+	if maxBuckets <= 0 {
+		maxBuckets = 160
+	}
+	s := otlpStatsOf(doc)
+	dp := &metricspb.ExponentialHistogramDataPoint{
+		StartTimeUnixNano: s.start,
+		TimeUnixNano:      s.end,
+		Count:             s.count,
+		Sum:               s.sum,
+		Scale:             maxOTLPScale,
+		Positive:          &metricspb.ExponentialHistogramDataPoint_Buckets{},
+		Min:               s.min,
+		Max:               s.max,
+	}
+
+	// bucket i holds values in (2^(i/2^scale), 2^((i+1)/2^scale)]
+	indexes := make([]int64, len(s.seconds))
+	var minIndex, maxIndex int64 = math.MaxInt64, math.MinInt64
+	for i, seconds := range s.seconds {
+		if seconds == 0 {
+			dp.ZeroCount += uint64(s.counts[i])
+			continue
+		}
+		indexes[i] = int64(math.Ceil(math.Ldexp(math.Log2(seconds), maxOTLPScale))) - 1
+		if indexes[i] < minIndex {
+			minIndex = indexes[i]
+		}
+		if indexes[i] > maxIndex {
+			maxIndex = indexes[i]
+		}
+	}
+	if minIndex > maxIndex {
+		dp.Scale = 0
+		return dp
+	}
+	// halving the scale merges each pair of adjacent buckets
+	var shift int32
+	for maxIndex>>shift-minIndex>>shift >= int64(maxBuckets) {
+		shift++
+	}
+	dp.Scale = maxOTLPScale - shift
+	dp.Positive.Offset = int32(minIndex >> shift)
+	dp.Positive.BucketCounts = make([]uint64, maxIndex>>shift-minIndex>>shift+1)
+	for i, seconds := range s.seconds {
+		if seconds != 0 {
+			dp.Positive.BucketCounts[indexes[i]>>shift-minIndex>>shift] += uint64(s.counts[i])
+		}
+	}
+	return dp
+}
+
+func otlpKeyValue(key string, value interface{}) *commonpb.KeyValue {
+	kv := &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{}}
+	switch v := value.(type) {
+	case bool:
+		kv.Value.Value = &commonpb.AnyValue_BoolValue{BoolValue: v}
+	case float64:
+		kv.Value.Value = &commonpb.AnyValue_DoubleValue{DoubleValue: v}
+	default:
+		s, _ := value.(string)
+		kv.Value.Value = &commonpb.AnyValue_StringValue{StringValue: s}
+	}
+	return kv
+}
+
+// otlpValue returns the string, bool, int64 or float64 held by v, nil for other types.
+func otlpValue(v *commonpb.AnyValue) interface{} {
+	switch v := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return v.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return v.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		return v.DoubleValue
+	}
+	return nil
+}
+
+func sortOTLPAttributes(attrs []*commonpb.KeyValue) {
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+}
+
+// otlpAttributesKey returns a string identifying the sorted attrs.
+func otlpAttributesKey(attrs []*commonpb.KeyValue) string {
+	var b strings.Builder
+	for _, kv := range attrs {
+		fmt.Fprintf(&b, "%q=%#v;", kv.Key, otlpValue(kv.Value))
+	}
+	return b.String()
+}
@@ -0,0 +1,108 @@
+package metricize
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func otlpTestDocs() []MetricDoc {
+	doc := MetricDoc{Timestamp: time.Unix(600, 0)}
+	doc.NumericLabels.Period = 600
+	doc.Service.Name = "svc"
+	doc.Service.Environment = "prod"
+	doc.Transaction.Name = "GET /"
+	doc.Transaction.Root = true
+	doc.DurationHistogram = DurationHistogram{Counts: []int64{2, 0, 1}, Values: []int64{1000000, 1500000, 2000000}}
+	other := doc
+	other.Service.Name = "other"
+	return []MetricDoc{doc, other}
+}
+
+func TestOTLPExporterExplicit(t *testing.T) {
+	e := OTLPExporter{Buckets: []float64{1, 1.5}, Scope: &commonpb.InstrumentationScope{Name: "metricize"}}
+	m, err := e.Metrics(otlpTestDocs())
+	require.NoError(t, err)
+	b, err := protojson.MarshalOptions{UseEnumNumbers: true}.Marshal(m)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"resourceMetrics": [
+		{
+			"resource": {"attributes": [
+				{"key": "deployment.environment", "value": {"stringValue": "prod"}},
+				{"key": "service.name", "value": {"stringValue": "other"}}
+			]},
+			"scopeMetrics": [{"scope": {"name": "metricize"}, "metrics": [{
+				"name": "transaction.duration",
+				"description": "Transaction duration rolled up by metricize.",
+				"unit": "s",
+				"histogram": {"aggregationTemporality": 1, "dataPoints": [{
+					"attributes": [
+						{"key": "transaction.name", "value": {"stringValue": "GET /"}},
+						{"key": "transaction.root", "value": {"boolValue": true}}
+					],
+					"startTimeUnixNano": "600000000000",
+					"timeUnixNano": "1200000000000",
+					"count": "3",
+					"sum": 4,
+					"bucketCounts": ["2", "0", "1"],
+					"explicitBounds": [1, 1.5],
+					"min": 1,
+					"max": 2
+				}]}
+			}]}]
+		},
+		{
+			"resource": {"attributes": [
+				{"key": "deployment.environment", "value": {"stringValue": "prod"}},
+				{"key": "service.name", "value": {"stringValue": "svc"}}
+			]},
+			"scopeMetrics": [{"scope": {"name": "metricize"}, "metrics": [{
+				"name": "transaction.duration",
+				"description": "Transaction duration rolled up by metricize.",
+				"unit": "s",
+				"histogram": {"aggregationTemporality": 1, "dataPoints": [{
+					"attributes": [
+						{"key": "transaction.name", "value": {"stringValue": "GET /"}},
+						{"key": "transaction.root", "value": {"boolValue": true}}
+					],
+					"startTimeUnixNano": "600000000000",
+					"timeUnixNano": "1200000000000",
+					"count": "3",
+					"sum": 4,
+					"bucketCounts": ["2", "0", "1"],
+					"explicitBounds": [1, 1.5],
+					"min": 1,
+					"max": 2
+				}]}
+			}]}]
+		}
+	]}`, string(b))
+}
+
+func TestOTLPExporterExponential(t *testing.T) {
+	e := OTLPExporter{Exponential: true, MaxBuckets: 4}
+	m, err := e.Metrics(otlpTestDocs()[:1])
+	require.NoError(t, err)
+	require.Len(t, m.ResourceMetrics, 1)
+	dps := m.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].GetExponentialHistogram().DataPoints
+	require.Len(t, dps, 1)
+	dp := dps[0]
+	// at scale 1, 1s falls in bucket -1 covering (2^-0.5, 1] and 2s in bucket 1 covering (2^0.5, 2]
+	require.EqualValues(t, 1, dp.Scale)
+	require.EqualValues(t, -1, dp.Positive.Offset)
+	require.Equal(t, []uint64{2, 0, 1}, dp.Positive.BucketCounts)
+	require.EqualValues(t, 3, dp.Count)
+	require.EqualValues(t, 0, dp.ZeroCount)
+
+	// a wider bucket limit keeps more precision
+	e.MaxBuckets = 160
+	m, err = e.Metrics(otlpTestDocs()[:1])
+	require.NoError(t, err)
+	dp = m.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].GetExponentialHistogram().DataPoints[0]
+	require.EqualValues(t, 7, dp.Scale)
+	require.EqualValues(t, -1, dp.Positive.Offset)
+	require.Len(t, dp.Positive.BucketCounts, 129)
+}
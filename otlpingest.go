@@ -0,0 +1,256 @@
+package metricize
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// OTLPDurationMetrics are the histogram metrics read as transaction durations from OTLP.
+var OTLPDurationMetrics = map[string]bool{
+	"http.server.duration":         true,
+	"http.server.request.duration": true,
+	"transaction.duration":         true,
+}
+
+// otlpFields maps OpenTelemetry attributes to the aggregation key fields they populate,
+// the inverse of otlpResourceAttributes.
+var otlpFields = func() map[string]string {
+	fields := make(map[string]string, len(otlpResourceAttributes))
+	for field, attr := range otlpResourceAttributes {
+		fields[attr] = field
+	}
+	return fields
+}()
+
+// OTLPMetricDocs converts the delta temporality histogram data points of the OTLPDurationMetrics in m into
+// transaction metrics, calling fn for each.
+// Resource and data point attributes populate the aggregation key, when of the type of the field, with HTTP
+// attributes standing in for the transaction name and result when absent, and histogram buckets are converted into
+// microsecond values at their midpoints.
+// Cumulative data points cannot be rolled up without their previous value and are skipped, returning how many.
+func OTLPMetricDocs(m *metricspb.MetricsData, fn func(*MetricDoc) error) (skipped int, err error) {
+	for _, rm := range m.ResourceMetrics {
+		resource := rm.GetResource().GetAttributes()
+		for _, sm := range rm.ScopeMetrics {
+			for _, metric := range sm.Metrics {
+				if !OTLPDurationMetrics[metric.Name] {
+					continue
+				}
+				micros, err := otlpMicrosPerUnit(metric)
+				if err != nil {
+					return skipped, err
+				}
+				if h := metric.GetHistogram(); h != nil {
+					if h.AggregationTemporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE {
+						skipped += len(h.DataPoints)
+						continue
+					}
+					for _, dp := range h.DataPoints {
+						doc, err := otlpMetricDoc(resource, dp.Attributes, dp.StartTimeUnixNano, dp.TimeUnixNano)
+						if err != nil {
+							return skipped, err
+						}
+						doc.DurationHistogram = explicitHistogram(dp, micros)
+						if err := fn(&doc); err != nil {
+							return skipped, err
+						}
+					}
+				}
+				if h := metric.GetExponentialHistogram(); h != nil {
+					if h.AggregationTemporality == metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE {
+						skipped += len(h.DataPoints)
+						continue
+					}
+					for _, dp := range h.DataPoints {
+						doc, err := otlpMetricDoc(resource, dp.Attributes, dp.StartTimeUnixNano, dp.TimeUnixNano)
+						if err != nil {
+							return skipped, err
+						}
+						doc.DurationHistogram = exponentialHistogram(dp, micros)
+						if err := fn(&doc); err != nil {
+							return skipped, err
+						}
+					}
+				}
+			}
+		}
+	}
+	return skipped, nil
+}
+
+// otlpMicrosPerUnit returns the number of microseconds in the unit of metric.
+func otlpMicrosPerUnit(metric *metricspb.Metric) (float64, error) {
+	unit := metric.Unit
+	if unit == "" && metric.Name == "http.server.duration" {
+		// the original semantic conventions recorded milliseconds
+		unit = "ms"
+	}
+	switch unit {
+	case "", "s":
+		return 1e6, nil
+	case "ms":
+		return 1e3, nil
+	case "us", "µs":
+		return 1, nil
+	case "ns":
+		return 1e-3, nil
+	}
+	return 0, fmt.Errorf("unsupported unit %q for %s", unit, metric.Name)
+}
+
+// otlpMetricDoc returns a transaction metrics document for a data point with the given attributes.
+func otlpMetricDoc(resource, attrs []*commonpb.KeyValue, start, end uint64) (MetricDoc, error) {
+	fields := make(map[string]interface{})
+	var method, route string
+	var status int64
+	for _, kv := range append(append([]*commonpb.KeyValue(nil), resource...), attrs...) {
+		value := otlpValue(kv.Value)
+		switch kv.Key {
+		case "http.method", "http.request.method":
+			method, _ = value.(string)
+		case "http.route":
+			route, _ = value.(string)
+		case "http.status_code", "http.response.status_code":
+			switch v := value.(type) {
+			case int64:
+				status = v
+			case float64:
+				status = int64(v)
+			}
+		default:
+			field, ok := otlpFields[kv.Key]
+			if !ok && isKeyField(kv.Key) {
+				field, ok = kv.Key, true
+			}
+			if !ok {
+				break
+			}
+			// attributes of another type than their field, e.g. an int service.version, are ignored
+			switch value.(type) {
+			case bool:
+				if field == "transaction.root" {
+					fields[field] = value
+				}
+			case string:
+				if field != "transaction.root" {
+					fields[field] = value
+				}
+			}
+		}
+	}
+	if fields["transaction.name"] == nil && (method != "" || route != "") {
+		name := route
+		if method != "" && route != "" {
+			name = method + " " + route
+		} else if route == "" {
+			name = method
+		}
+		fields["transaction.name"] = name
+		if fields["transaction.type"] == nil {
+			fields["transaction.type"] = "request"
+		}
+	}
+	if status > 0 {
+		if fields["transaction.result"] == nil {
+			fields["transaction.result"] = fmt.Sprintf("HTTP %dxx", status/100)
+		}
+		if fields["event.outcome"] == nil {
+			outcome := "success"
+			if status >= 500 {
+				outcome = "failure"
+			}
+			fields["event.outcome"] = outcome
+		}
+	}
+	if agent, ok := fields["agent.name"].(string); ok && agent == "opentelemetry" {
+		if language, ok := fields["service.language.name"].(string); ok {
+			fields["agent.name"] = agent + "/" + language
+		}
+	}
+
+	doc, err := MetricDocFromFields(fields)
+	if err != nil {
+		return doc, err
+	}
+	doc.Metricset.Name = "transaction"
+	// a delta data point covers [start, end), roll it up with the interval it started in
+	ts := start
+	if ts == 0 {
+		ts = end
+	}
+	doc.Timestamp = time.Unix(0, int64(ts)).UTC()
+	return doc, nil
+}
+
+func isKeyField(field string) bool {
+	for _, f := range keyFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// explicitHistogram converts explicit buckets into values at the midpoint of each bucket, the upper bound of
+// the first for values below it and the lower bound of the last, unbounded, bucket.
+func explicitHistogram(dp *metricspb.HistogramDataPoint, micros float64) DurationHistogram {
+	var dh DurationHistogram
+	bounds := dp.ExplicitBounds
+	for i, count := range dp.BucketCounts {
+		if count == 0 {
+			continue
+		}
+		var v float64
+		switch {
+		case len(bounds) == 0:
+			if dp.Sum != nil && dp.Count > 0 {
+				v = dp.GetSum() / float64(dp.Count)
+			}
+		case i == 0:
+			v = bounds[0]
+			if v > 0 {
+				v /= 2
+			}
+		case i >= len(bounds):
+			v = bounds[len(bounds)-1]
+		default:
+			v = (bounds[i-1] + bounds[i]) / 2
+		}
+		dh.Values = append(dh.Values, toMicros(v, micros))
+		dh.Counts = append(dh.Counts, int64(count))
+	}
+	return dh
+}
+
+// exponentialHistogram converts exponential buckets into values at the midpoint of each bucket.
+func exponentialHistogram(dp *metricspb.ExponentialHistogramDataPoint, micros float64) DurationHistogram {
+	var dh DurationHistogram
+	if dp.ZeroCount > 0 {
+		dh.Values = append(dh.Values, 0)
+		dh.Counts = append(dh.Counts, int64(dp.ZeroCount))
+	}
+	for i, count := range dp.GetPositive().GetBucketCounts() {
+		if count == 0 {
+			continue
+		}
+		index := float64(int64(dp.GetPositive().GetOffset()) + int64(i))
+		lower := math.Exp2(math.Ldexp(index, -int(dp.Scale)))
+		upper := math.Exp2(math.Ldexp(index+1, -int(dp.Scale)))
+		dh.Values = append(dh.Values, toMicros((lower+upper)/2, micros))
+		dh.Counts = append(dh.Counts, int64(count))
+	}
+	return dh
+}
+
+// toMicros converts v to whole microseconds, given the microseconds per unit of v.
+func toMicros(v, micros float64) int64 {
+	us := math.Round(v * micros)
+	if us < 0 {
+		return 0
+	}
+	return int64(us)
+}
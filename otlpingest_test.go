@@ -0,0 +1,128 @@
+package metricize
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func otlpMetricDocs(t *testing.T, m *metricspb.MetricsData) ([]MetricDoc, int) {
+	var docs []MetricDoc
+	skipped, err := OTLPMetricDocs(m, func(doc *MetricDoc) error {
+		docs = append(docs, *doc)
+		return nil
+	})
+	require.NoError(t, err)
+	return docs, skipped
+}
+
+func TestOTLPMetricDocsHTTP(t *testing.T) {
+	var m metricspb.MetricsData
+	require.NoError(t, protojson.Unmarshal([]byte(`{"resourceMetrics": [{
+		"resource": {"attributes": [
+			{"key": "service.name", "value": {"stringValue": "checkout"}},
+			{"key": "deployment.environment", "value": {"stringValue": "prod"}},
+			{"key": "telemetry.sdk.name", "value": {"stringValue": "opentelemetry"}},
+			{"key": "telemetry.sdk.language", "value": {"stringValue": "go"}},
+			{"key": "process.pid", "value": {"intValue": "42"}}
+		]},
+		"scopeMetrics": [{"metrics": [
+			{
+				"name": "http.server.duration",
+				"unit": "ms",
+				"histogram": {"aggregationTemporality": 1, "dataPoints": [{
+					"attributes": [
+						{"key": "http.method", "value": {"stringValue": "GET"}},
+						{"key": "http.route", "value": {"stringValue": "/cart/{id}"}},
+						{"key": "http.status_code", "value": {"intValue": "503"}}
+					],
+					"startTimeUnixNano": "600000000000",
+					"timeUnixNano": "660000000000",
+					"count": "6",
+					"bucketCounts": ["1", "0", "3", "2"],
+					"explicitBounds": [10, 20, 50]
+				}]}
+			},
+			{
+				"name": "http.server.request.duration",
+				"unit": "s",
+				"histogram": {"aggregationTemporality": 2, "dataPoints": [{"count": "1", "bucketCounts": ["1"]}]}
+			},
+			{
+				"name": "http.client.duration",
+				"unit": "ms",
+				"histogram": {"aggregationTemporality": 1, "dataPoints": [{"count": "1", "bucketCounts": ["1"]}]}
+			}
+		]}]
+	}]}`), &m))
+
+	docs, skipped := otlpMetricDocs(t, &m)
+	require.Equal(t, 1, skipped)
+	require.Len(t, docs, 1)
+	doc := docs[0]
+	require.Equal(t, time.Unix(600, 0).UTC(), doc.Timestamp)
+	require.Equal(t, "transaction", doc.Metricset.Name)
+	fields, err := doc.Fields(keyFields...)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{
+		"agent.name":            "opentelemetry/go",
+		"service.name":          "checkout",
+		"service.environment":   "prod",
+		"service.language.name": "go",
+		"transaction.name":      "GET /cart/{id}",
+		"transaction.type":      "request",
+		"transaction.result":    "HTTP 5xx",
+		"event.outcome":         "failure",
+	}, fields)
+	require.Equal(t, DurationHistogram{
+		Counts: []int64{1, 3, 2},
+		Values: []int64{5000, 35000, 50000},
+	}, doc.DurationHistogram)
+}
+
+func TestOTLPMetricDocsRoundTrip(t *testing.T) {
+	encodings := map[string]struct {
+		marshal   func(proto.Message) ([]byte, error)
+		unmarshal func([]byte, proto.Message) error
+	}{
+		"protobuf": {proto.Marshal, proto.Unmarshal},
+		"json":     {protojson.MarshalOptions{UseEnumNumbers: true}.Marshal, protojson.Unmarshal},
+	}
+	for name, e := range map[string]OTLPExporter{
+		"explicit":    {Buckets: []float64{1, 1.5, 2.5}},
+		"exponential": {Exponential: true},
+	} {
+		for encoding, codec := range encodings {
+			t.Run(name+"/"+encoding, func(t *testing.T) {
+				m, err := e.Metrics(otlpTestDocs())
+				require.NoError(t, err)
+				b, err := codec.marshal(m)
+				require.NoError(t, err)
+				var decoded metricspb.MetricsData
+				require.NoError(t, codec.unmarshal(b, &decoded))
+				docs, skipped := otlpMetricDocs(t, &decoded)
+				require.Zero(t, skipped)
+
+				require.Len(t, docs, 2)
+				a := NewAggregator(time.Unix(600, 0))
+				for i := range docs {
+					require.Equal(t, []int64{2, 1}, docs[i].DurationHistogram.Counts)
+					// values come back within their buckets rather than exactly
+					require.InDelta(t, 1000000, docs[i].DurationHistogram.Values[0], 500000)
+					require.InDelta(t, 2000000, docs[i].DurationHistogram.Values[1], 10000)
+					require.NoError(t, a.Aggregate(&docs[i]))
+				}
+				require.Len(t, a.Buckets, 2)
+				for key := range a.Buckets {
+					doc := a.Emit(key)
+					require.Equal(t, "GET /", doc.Transaction.Name)
+					require.True(t, doc.Transaction.Root)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,491 @@
+package metricize
+
+import (
+	"encoding/binary"
+	"io"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ParquetExporter writes rollup documents as an uncompressed Parquet file, with a row per document holding its
+// timestamp, aggregation key fields, transaction count and duration statistics in microseconds, and the
+// duration histogram itself as the repeated duration_histogram_values and duration_histogram_counts columns.
+// Column names replace the dots of field names with underscores, dots being path separators in Parquet.
+//
+// The file is encoded here rather than with a Parquet library: the maintained ones, such as
+// github.com/parquet-go/parquet-go, are not yet among the dependencies of this module, and the handful of metadata
+// structs and plain encoded pages written are simple enough to keep in tree until one is.
+type ParquetExporter struct {
+	// Percentiles are the duration percentiles written, defaults to DefaultPercentiles.
+	Percentiles []float64
+	// RowGroupSize is the number of rows after which a row group is written, defaults to
+	// DefaultParquetRowGroupSize.
+	RowGroupSize int
+}
+
+// DefaultParquetRowGroupSize is the number of rows of a row group when a ParquetExporter sets none.
+const DefaultParquetRowGroupSize = 1 << 16
+
+// Parquet physical types, repetitions, converted types and encodings, see parquet.thrift.
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetRequired = 0
+	parquetOptional = 1
+	parquetRepeated = 2
+
+	parquetNone            = -1
+	parquetUTF8            = 0
+	parquetTimestampMicros = 10
+
+	parquetPlain = 0
+	parquetRLE   = 3
+)
+
+var parquetMagic = []byte("PAR1")
+
+// parquetColumn collects the values, and repetition and definition levels, of a column.
+type parquetColumn struct {
+	name       string
+	typ        int32
+	converted  int32
+	repetition int32
+
+	// values counts the column values, including nulls and empty lists
+	values     int
+	reps, defs []byte
+	bools      []bool
+	data       []byte
+}
+
+func (c *parquetColumn) level(defined bool) {
+	c.values++
+	if c.repetition == parquetOptional {
+		if defined {
+			c.defs = append(c.defs, 1)
+		} else {
+			c.defs = append(c.defs, 0)
+		}
+	}
+}
+
+func (c *parquetColumn) appendInt64(v int64, defined bool) {
+	c.level(defined)
+	if defined {
+		c.data = binary.LittleEndian.AppendUint64(c.data, uint64(v))
+	}
+}
+
+func (c *parquetColumn) appendString(v string, defined bool) {
+	c.level(defined)
+	if defined {
+		c.data = binary.LittleEndian.AppendUint32(c.data, uint32(len(v)))
+		c.data = append(c.data, v...)
+	}
+}
+
+func (c *parquetColumn) appendBool(v bool, defined bool) {
+	c.level(defined)
+	if defined {
+		c.bools = append(c.bools, v)
+	}
+}
+
+// appendInt64s adds a row of a repeated column, an empty list when vs is.
+func (c *parquetColumn) appendInt64s(vs []int64) {
+	if len(vs) == 0 {
+		c.values++
+		c.reps = append(c.reps, 0)
+		c.defs = append(c.defs, 0)
+		return
+	}
+	for i, v := range vs {
+		c.values++
+		if i == 0 {
+			c.reps = append(c.reps, 0)
+		} else {
+			c.reps = append(c.reps, 1)
+		}
+		c.defs = append(c.defs, 1)
+		c.data = binary.LittleEndian.AppendUint64(c.data, uint64(v))
+	}
+}
+
+// page returns the body of a version 1 data page holding the whole column.
+func (c *parquetColumn) page() []byte {
+	var b []byte
+	if c.repetition == parquetRepeated {
+		b = appendParquetLevels(b, c.reps)
+	}
+	if c.repetition != parquetRequired {
+		b = appendParquetLevels(b, c.defs)
+	}
+	if c.typ == parquetBoolean {
+		packed := make([]byte, (len(c.bools)+7)/8)
+		for i, v := range c.bools {
+			if v {
+				packed[i/8] |= 1 << (i % 8)
+			}
+		}
+		b = append(b, packed...)
+	}
+	return append(b, c.data...)
+}
+
+// appendParquetLevels appends levels of at most 1 using the length prefixed RLE encoding, as runs of equal levels.
+func appendParquetLevels(b []byte, levels []byte) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0)
+	for i := 0; i < len(levels); {
+		j := i + 1
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		b = protowire.AppendVarint(b, uint64(j-i)<<1)
+		b = append(b, levels[i])
+		i = j
+	}
+	binary.LittleEndian.PutUint32(b[start:], uint32(len(b)-start-4))
+	return b
+}
+
+// Write writes docs to w, ordered by timestamp and then aggregation key.
+// Duration statistics of documents without any transactions are null.
+func (e *ParquetExporter) Write(w io.Writer, docs []MetricDoc) error {
+	pw := e.NewWriter(w)
+	if err := pw.Write(docs); err != nil {
+		return err
+	}
+	return pw.Close()
+}
+
+// NewWriter returns a ParquetWriter writing to w, for writing documents a batch at a time as they are rolled up.
+func (e *ParquetExporter) NewWriter(w io.Writer) *ParquetWriter {
+	percentiles := e.Percentiles
+	if len(percentiles) == 0 {
+		percentiles = DefaultPercentiles
+	}
+	rowGroupSize := e.RowGroupSize
+	if rowGroupSize <= 0 {
+		rowGroupSize = DefaultParquetRowGroupSize
+	}
+	return &ParquetWriter{
+		w:            w,
+		percentiles:  percentiles,
+		rowGroupSize: rowGroupSize,
+		group:        newParquetRowGroup(percentiles),
+	}
+}
+
+// ParquetWriter writes rollup documents as Parquet a batch at a time, see ParquetExporter.
+// Only the rows of the row group being filled are held in memory, along with the metadata of those written.
+type ParquetWriter struct {
+	w            io.Writer
+	percentiles  []float64
+	rowGroupSize int
+
+	group *parquetRowGroup
+	// offset is the number of bytes written, zero until the magic number is
+	offset    int64
+	rows      int64
+	rowGroups []parquetRowGroupMeta
+}
+
+// parquetRowGroup collects the columns of a row group.
+type parquetRowGroup struct {
+	timestamp      *parquetColumn
+	keys           []*parquetColumn
+	count, sum     *parquetColumn
+	min, max       *parquetColumn
+	percentiles    []*parquetColumn
+	values, counts *parquetColumn
+	rows           int
+}
+
+// parquetRowGroupMeta is a row group written, with the encoded metadata of its column chunks.
+type parquetRowGroupMeta struct {
+	chunks [][]byte
+	size   int64
+	rows   int64
+}
+
+func newParquetRowGroup(percentiles []float64) *parquetRowGroup {
+	g := &parquetRowGroup{
+		timestamp: &parquetColumn{name: "timestamp", typ: parquetInt64, converted: parquetTimestampMicros},
+		keys:      make([]*parquetColumn, len(keyFields)),
+		count:     &parquetColumn{name: "count", typ: parquetInt64, converted: parquetNone},
+		sum:       &parquetColumn{name: "duration_sum_us", typ: parquetInt64, converted: parquetNone},
+		min:       &parquetColumn{name: "duration_min_us", typ: parquetInt64, converted: parquetNone, repetition: parquetOptional},
+		max:       &parquetColumn{name: "duration_max_us", typ: parquetInt64, converted: parquetNone, repetition: parquetOptional},
+		values:    &parquetColumn{name: "duration_histogram_values", typ: parquetInt64, converted: parquetNone, repetition: parquetRepeated},
+		counts:    &parquetColumn{name: "duration_histogram_counts", typ: parquetInt64, converted: parquetNone, repetition: parquetRepeated},
+	}
+	for i, field := range keyFields {
+		g.keys[i] = &parquetColumn{
+			name:       strings.ReplaceAll(field, ".", "_"),
+			typ:        parquetByteArray,
+			converted:  parquetUTF8,
+			repetition: parquetOptional,
+		}
+		// the only key field that is not a string
+		if field == "transaction.root" {
+			g.keys[i].typ, g.keys[i].converted = parquetBoolean, parquetNone
+		}
+	}
+	for _, p := range percentiles {
+		g.percentiles = append(g.percentiles, &parquetColumn{
+			name:       percentileColumn(p),
+			typ:        parquetInt64,
+			converted:  parquetNone,
+			repetition: parquetOptional,
+		})
+	}
+	return g
+}
+
+// columns returns the columns of g in schema order.
+func (g *parquetRowGroup) columns() []*parquetColumn {
+	columns := append([]*parquetColumn{g.timestamp}, g.keys...)
+	columns = append(columns, g.count, g.sum, g.min, g.max)
+	columns = append(columns, g.percentiles...)
+	return append(columns, g.values, g.counts)
+}
+
+func (g *parquetRowGroup) append(row *tabularRow, percentiles []float64) {
+	g.rows++
+	g.timestamp.appendInt64(row.doc.Timestamp.UnixMicro(), true)
+	for i, field := range keyFields {
+		value, ok := row.fields[field]
+		if g.keys[i].typ == parquetBoolean {
+			b, _ := value.(bool)
+			g.keys[i].appendBool(b, ok)
+		} else {
+			s, _ := value.(string)
+			g.keys[i].appendString(s, ok)
+		}
+	}
+	s := row.stats
+	g.count.appendInt64(s.count, true)
+	g.sum.appendInt64(s.sum, true)
+	g.min.appendInt64(s.min, s.count > 0)
+	g.max.appendInt64(s.max, s.count > 0)
+	for i, p := range percentiles {
+		g.percentiles[i].appendInt64(s.percentile(p), s.count > 0)
+	}
+	g.values.appendInt64s(s.values)
+	g.counts.appendInt64s(s.counts)
+}
+
+// Write adds docs to the file, ordered by timestamp and then aggregation key, writing the row group being filled
+// whenever it reaches the row group size.
+// Duration statistics of documents without any transactions are null.
+func (w *ParquetWriter) Write(docs []MetricDoc) error {
+	rows, err := tabularRowsOf(docs)
+	if err != nil {
+		return err
+	}
+	for i := range rows {
+		w.group.append(&rows[i], w.percentiles)
+		if w.group.rows >= w.rowGroupSize {
+			if err := w.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *ParquetWriter) writeMagic() error {
+	if w.offset > 0 {
+		return nil
+	}
+	if _, err := w.w.Write(parquetMagic); err != nil {
+		return err
+	}
+	w.offset = int64(len(parquetMagic))
+	return nil
+}
+
+// flush writes the row group being filled, as a single data page per column chunk, and starts another.
+func (w *ParquetWriter) flush() error {
+	if err := w.writeMagic(); err != nil {
+		return err
+	}
+	columns := w.group.columns()
+	meta := parquetRowGroupMeta{chunks: make([][]byte, len(columns)), rows: int64(w.group.rows)}
+	for i, c := range columns {
+		page := c.page()
+		var header thriftWriter
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(page)))
+		header.structField(5, func(h *thriftWriter) {
+			h.i32(1, int32(c.values))
+			h.i32(2, parquetPlain)
+			h.i32(3, parquetRLE)
+			h.i32(4, parquetRLE)
+		})
+		chunk := append(header.end(), page...)
+		size := int64(len(chunk))
+
+		var chunkMeta thriftWriter
+		chunkMeta.i64(2, w.offset)
+		chunkMeta.structField(3, func(m *thriftWriter) {
+			m.i32(1, c.typ)
+			m.i32s(2, []int32{parquetPlain, parquetRLE})
+			m.strings(3, []string{c.name})
+			m.i32(4, 0) // UNCOMPRESSED
+			m.i64(5, int64(c.values))
+			m.i64(6, size)
+			m.i64(7, size)
+			m.i64(9, w.offset)
+		})
+		meta.chunks[i] = chunkMeta.end()
+
+		if _, err := w.w.Write(chunk); err != nil {
+			return err
+		}
+		w.offset += size
+		meta.size += size
+	}
+	w.rows += meta.rows
+	w.rowGroups = append(w.rowGroups, meta)
+	w.group = newParquetRowGroup(w.percentiles)
+	return nil
+}
+
+// Close writes the last row group and the footer, leaving the underlying writer open.
+// A file without any documents holds a single empty row group.
+func (w *ParquetWriter) Close() error {
+	if w.group.rows > 0 || len(w.rowGroups) == 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	columns := w.group.columns()
+	var footer thriftWriter
+	footer.i32(1, 1)
+	footer.structs(2, len(columns)+1, func(i int, s *thriftWriter) {
+		if i == 0 {
+			s.str(4, "schema")
+			s.i32(5, int32(len(columns)))
+			return
+		}
+		c := columns[i-1]
+		s.i32(1, c.typ)
+		s.i32(3, c.repetition)
+		s.str(4, c.name)
+		if c.converted != parquetNone {
+			s.i32(6, c.converted)
+		}
+	})
+	footer.i64(3, w.rows)
+	footer.structs(4, len(w.rowGroups), func(i int, rg *thriftWriter) {
+		meta := w.rowGroups[i]
+		rg.structs(1, len(meta.chunks), func(j int, c *thriftWriter) {
+			c.raw(meta.chunks[j])
+		})
+		rg.i64(2, meta.size)
+		rg.i64(3, meta.rows)
+	})
+	footer.str(6, "metricize")
+	b := footer.end()
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(b)))
+	b = append(b, parquetMagic...)
+	_, err := w.w.Write(b)
+	return err
+}
+
+// Thrift compact protocol field types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter appends the fields of a struct in the Thrift compact protocol, as Parquet metadata is encoded.
+// Fields must be added in increasing order of ID.
+type thriftWriter struct {
+	b    []byte
+	last int16
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.b = append(t.b, byte(delta)<<4|typ)
+	} else {
+		t.b = append(t.b, typ)
+		t.b = protowire.AppendVarint(t.b, protowire.EncodeZigZag(int64(id)))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.b = protowire.AppendVarint(t.b, protowire.EncodeZigZag(int64(v)))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.b = protowire.AppendVarint(t.b, protowire.EncodeZigZag(v))
+}
+
+func (t *thriftWriter) str(id int16, v string) {
+	t.field(id, thriftBinary)
+	t.b = protowire.AppendString(t.b, v)
+}
+
+func (t *thriftWriter) list(id int16, typ byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.b = append(t.b, byte(n)<<4|typ)
+	} else {
+		t.b = append(t.b, 0xf0|typ)
+		t.b = protowire.AppendVarint(t.b, uint64(n))
+	}
+}
+
+func (t *thriftWriter) i32s(id int16, vs []int32) {
+	t.list(id, thriftI32, len(vs))
+	for _, v := range vs {
+		t.b = protowire.AppendVarint(t.b, protowire.EncodeZigZag(int64(v)))
+	}
+}
+
+func (t *thriftWriter) strings(id int16, vs []string) {
+	t.list(id, thriftBinary, len(vs))
+	for _, v := range vs {
+		t.b = protowire.AppendString(t.b, v)
+	}
+}
+
+func (t *thriftWriter) structField(id int16, fn func(*thriftWriter)) {
+	t.field(id, thriftStruct)
+	nested := thriftWriter{b: t.b}
+	fn(&nested)
+	t.b = nested.end()
+}
+
+func (t *thriftWriter) structs(id int16, n int, fn func(int, *thriftWriter)) {
+	t.list(id, thriftStruct, n)
+	for i := 0; i < n; i++ {
+		nested := thriftWriter{b: t.b}
+		fn(i, &nested)
+		t.b = nested.end()
+	}
+}
+
+// raw appends the fields of an already encoded struct, without its stop byte.
+func (t *thriftWriter) raw(b []byte) {
+	t.b = append(t.b, b[:len(b)-1]...)
+}
+
+// end returns the encoded struct, terminated by a stop byte.
+func (t *thriftWriter) end() []byte {
+	return append(t.b, 0)
+}
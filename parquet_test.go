@@ -0,0 +1,324 @@
+package metricize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// thriftReader decodes the Thrift compact protocol, enough to read back what ParquetExporter writes.
+type thriftReader struct {
+	t *testing.T
+	b []byte
+}
+
+func (r *thriftReader) varint() uint64 {
+	v, n := protowire.ConsumeVarint(r.b)
+	require.GreaterOrEqual(r.t, n, 0)
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftI32, thriftI64:
+		return protowire.DecodeZigZag(r.varint())
+	case thriftBinary:
+		n := r.varint()
+		s := string(r.b[:n])
+		r.b = r.b[n:]
+		return s
+	case thriftList:
+		h := r.b[0]
+		r.b = r.b[1:]
+		n := uint64(h >> 4)
+		if n == 15 {
+			n = r.varint()
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = r.value(h & 0xf)
+		}
+		return list
+	case thriftStruct:
+		return r.structValue()
+	}
+	r.t.Fatalf("unexpected thrift type %d", typ)
+	return nil
+}
+
+func (r *thriftReader) structValue() map[int16]interface{} {
+	fields := make(map[int16]interface{})
+	var last int16
+	for {
+		h := r.b[0]
+		r.b = r.b[1:]
+		if h == 0 {
+			return fields
+		}
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			id = int16(protowire.DecodeZigZag(r.varint()))
+		}
+		last = id
+		fields[id] = r.value(h & 0xf)
+	}
+}
+
+// parquetThriftField is a field of a parquet.thrift struct: its compact protocol type, whether it is required,
+// and for lists the type of their elements. structName names the struct of values or elements that are structs.
+type parquetThriftField struct {
+	typ        byte
+	required   bool
+	elem       byte
+	structName string
+}
+
+// parquetThriftStructs are the parquet.thrift structs, limited to the fields ParquetExporter may write.
+var parquetThriftStructs = map[string]map[int16]parquetThriftField{
+	"FileMetaData": {
+		1: {typ: thriftI32, required: true},
+		2: {typ: thriftList, required: true, elem: thriftStruct, structName: "SchemaElement"},
+		3: {typ: thriftI64, required: true},
+		4: {typ: thriftList, required: true, elem: thriftStruct, structName: "RowGroup"},
+		6: {typ: thriftBinary},
+	},
+	"SchemaElement": {
+		1: {typ: thriftI32},
+		3: {typ: thriftI32},
+		4: {typ: thriftBinary, required: true},
+		5: {typ: thriftI32},
+		6: {typ: thriftI32},
+	},
+	"RowGroup": {
+		1: {typ: thriftList, required: true, elem: thriftStruct, structName: "ColumnChunk"},
+		2: {typ: thriftI64, required: true},
+		3: {typ: thriftI64, required: true},
+	},
+	"ColumnChunk": {
+		2: {typ: thriftI64, required: true},
+		3: {typ: thriftStruct, structName: "ColumnMetaData"},
+	},
+	"ColumnMetaData": {
+		1: {typ: thriftI32, required: true},
+		2: {typ: thriftList, required: true, elem: thriftI32},
+		3: {typ: thriftList, required: true, elem: thriftBinary},
+		4: {typ: thriftI32, required: true},
+		5: {typ: thriftI64, required: true},
+		6: {typ: thriftI64, required: true},
+		7: {typ: thriftI64, required: true},
+		9: {typ: thriftI64, required: true},
+	},
+	"PageHeader": {
+		1: {typ: thriftI32, required: true},
+		2: {typ: thriftI32, required: true},
+		3: {typ: thriftI32, required: true},
+		5: {typ: thriftStruct, structName: "DataPageHeader"},
+	},
+	"DataPageHeader": {
+		1: {typ: thriftI32, required: true},
+		2: {typ: thriftI32, required: true},
+		3: {typ: thriftI32, required: true},
+		4: {typ: thriftI32, required: true},
+	},
+}
+
+// conform reads the struct called name, failing unless it holds the fields parquet.thrift defines for it, with
+// their types, as readers generated from parquet.thrift expect.
+func (r *thriftReader) conform(name string) {
+	def := parquetThriftStructs[name]
+	seen := make(map[int16]bool)
+	var last int16
+	for {
+		h := r.b[0]
+		r.b = r.b[1:]
+		if h == 0 {
+			break
+		}
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			id = int16(protowire.DecodeZigZag(r.varint()))
+		}
+		require.Greater(r.t, id, last, "%s fields out of order", name)
+		last = id
+		f, ok := def[id]
+		require.True(r.t, ok, "%s has no field %d", name, id)
+		require.Equal(r.t, f.typ, h&0xf, "type of %s field %d", name, id)
+		seen[id] = true
+		switch f.typ {
+		case thriftStruct:
+			r.conform(f.structName)
+		case thriftList:
+			lh := r.b[0]
+			r.b = r.b[1:]
+			require.Equal(r.t, f.elem, lh&0xf, "element type of %s field %d", name, id)
+			n := uint64(lh >> 4)
+			if n == 15 {
+				n = r.varint()
+			}
+			for i := uint64(0); i < n; i++ {
+				if f.elem == thriftStruct {
+					r.conform(f.structName)
+				} else {
+					r.value(f.elem)
+				}
+			}
+		default:
+			r.value(f.typ)
+		}
+	}
+	for id, f := range def {
+		require.True(r.t, seen[id] || !f.required, "%s lacks required field %d", name, id)
+	}
+}
+
+// parquetLevels decodes length prefixed RLE levels written by appendParquetLevels.
+func parquetLevels(t *testing.T, b []byte) ([]byte, []byte) {
+	n := binary.LittleEndian.Uint32(b)
+	r := thriftReader{t: t, b: b[4 : 4+n]}
+	var levels []byte
+	for len(r.b) > 0 {
+		run := r.varint()
+		require.Zero(t, run&1, "bit packed run")
+		levels = append(levels, bytes.Repeat(r.b[:1], int(run>>1))...)
+		r.b = r.b[1:]
+	}
+	return levels, b[4+n:]
+}
+
+func TestParquetExporter(t *testing.T) {
+	var buf bytes.Buffer
+	e := ParquetExporter{Percentiles: []float64{50}}
+	require.NoError(t, e.Write(&buf, tabularTestDocs()))
+	b := buf.Bytes()
+	meta := parquetFooter(t, b)
+	require.Equal(t, int64(3), meta[3])
+	require.Equal(t, "metricize", meta[6])
+
+	schema := meta[2].([]interface{})
+	columns := len(keyFields) + 8
+	require.Len(t, schema, columns+1)
+	require.Equal(t, int64(columns), schema[0].(map[int16]interface{})[5])
+
+	// read back every column, keyed by name
+	type column struct {
+		reps, defs []byte
+		values     []byte
+	}
+	read := make(map[string]column)
+	rowGroup := meta[4].([]interface{})[0].(map[int16]interface{})
+	chunks := rowGroup[1].([]interface{})
+	require.Len(t, chunks, columns)
+	// chunks follow each other from the magic number on, their sizes adding up to that of the row group
+	offset, size := int64(len(parquetMagic)), int64(0)
+	for i, chunk := range chunks {
+		element := schema[i+1].(map[int16]interface{})
+		md := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+		require.Equal(t, element[4], md[3].([]interface{})[0])
+		require.Equal(t, element[1], md[1])
+		require.Equal(t, offset, md[9])
+		require.Equal(t, offset, chunk.(map[int16]interface{})[2])
+		r := thriftReader{t: t, b: b[md[9].(int64):]}
+		conforming := r
+		conforming.conform("PageHeader")
+		header := r.structValue()
+		require.Equal(t, md[5], header[5].(map[int16]interface{})[1])
+		require.Equal(t, md[7], int64(len(b[offset:]))-int64(len(r.b))+header[3].(int64))
+		offset += md[7].(int64)
+		size += md[7].(int64)
+		page := r.b[:header[3].(int64)]
+		var c column
+		switch element[3] {
+		case int64(parquetRepeated):
+			c.reps, page = parquetLevels(t, page)
+			c.defs, page = parquetLevels(t, page)
+		case int64(parquetOptional):
+			c.defs, page = parquetLevels(t, page)
+		}
+		c.values = page
+		read[element[4].(string)] = c
+	}
+	require.Equal(t, rowGroup[2], size)
+	require.Equal(t, meta[3], rowGroup[3])
+
+	int64s := func(b []byte) []int64 {
+		var vs []int64
+		for ; len(b) > 0; b = b[8:] {
+			vs = append(vs, int64(binary.LittleEndian.Uint64(b)))
+		}
+		return vs
+	}
+	require.Equal(t, []int64{600e6, 1200e6, 1200e6}, int64s(read["timestamp"].values))
+	require.Equal(t, []byte{1, 1, 1}, read["service_name"].defs)
+	require.Equal(t, "\x01\x00\x00\x00a\x01\x00\x00\x00a\x01\x00\x00\x00b", string(read["service_name"].values))
+	require.Equal(t, []byte{0, 0, 0}, read["cloud_region"].defs)
+	require.Empty(t, read["cloud_region"].values)
+	// true, true, false bit packed
+	require.Equal(t, []byte{0b011}, read["transaction_root"].values)
+	require.Equal(t, []int64{10, 4, 0}, int64s(read["count"].values))
+	require.Equal(t, []byte{1, 1, 0}, read["duration_p50_us"].defs)
+	require.Equal(t, []int64{100, 20000}, int64s(read["duration_p50_us"].values))
+	require.Equal(t, []byte{0, 1, 1, 0, 0}, read["duration_histogram_values"].reps)
+	require.Equal(t, []byte{1, 1, 1, 1, 0}, read["duration_histogram_values"].defs)
+	require.Equal(t, []int64{100, 5000, 2000000, 20000}, int64s(read["duration_histogram_values"].values))
+	require.Equal(t, []int64{8, 1, 1, 4}, int64s(read["duration_histogram_counts"].values))
+}
+
+// parquetFooter returns the conforming file metadata of the Parquet file b.
+func parquetFooter(t *testing.T, b []byte) map[int16]interface{} {
+	require.Equal(t, parquetMagic, b[:4])
+	require.Equal(t, parquetMagic, b[len(b)-4:])
+	footerLen := binary.LittleEndian.Uint32(b[len(b)-8:])
+	footer := thriftReader{t: t, b: b[len(b)-8-int(footerLen) : len(b)-8]}
+	conforming := footer
+	conforming.conform("FileMetaData")
+	require.Empty(t, conforming.b)
+	meta := footer.structValue()
+	require.Empty(t, footer.b)
+	return meta
+}
+
+func TestParquetWriterRowGroups(t *testing.T) {
+	var buf bytes.Buffer
+	w := (&ParquetExporter{RowGroupSize: 2}).NewWriter(&buf)
+	docs := tabularTestDocs()
+	require.NoError(t, w.Write(docs[:1]))
+	// nothing is written until a row group fills
+	require.Zero(t, buf.Len())
+	require.NoError(t, w.Write(docs[1:]))
+	// the first 2 rows are, the last is left until closing
+	written := buf.Len()
+	require.NotZero(t, written)
+	require.NoError(t, w.Close())
+
+	meta := parquetFooter(t, buf.Bytes())
+	require.Equal(t, int64(3), meta[3])
+	rowGroups := meta[4].([]interface{})
+	require.Len(t, rowGroups, 2)
+	// row groups follow each other from the magic number on
+	offset := int64(len(parquetMagic))
+	for i, rows := range []int64{2, 1} {
+		rowGroup := rowGroups[i].(map[int16]interface{})
+		require.Equal(t, rows, rowGroup[3])
+		chunks := rowGroup[1].([]interface{})
+		first := chunks[0].(map[int16]interface{})[3].(map[int16]interface{})
+		require.Equal(t, offset, first[9])
+		require.Equal(t, rows, first[5])
+		offset += rowGroup[2].(int64)
+	}
+	require.Equal(t, int64(written), int64(len(parquetMagic))+rowGroups[0].(map[int16]interface{})[2].(int64))
+}
+
+func TestParquetWriterEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	w := (&ParquetExporter{}).NewWriter(&buf)
+	require.NoError(t, w.Close())
+	meta := parquetFooter(t, buf.Bytes())
+	require.Equal(t, int64(0), meta[3])
+	rowGroups := meta[4].([]interface{})
+	require.Len(t, rowGroups, 1)
+	require.Equal(t, int64(0), rowGroups[0].(map[int16]interface{})[3])
+}
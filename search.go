@@ -0,0 +1,122 @@
+package metricize
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// SearchHit is a single hit of a search response.
+type SearchHit struct {
+	Source MetricDoc     `json:"_source"`
+	Sort   []interface{} `json:"sort"`
+}
+
+// DecodeSearchHits streams the hits of a search response read from r, calling fn for each hit as it is parsed
+// rather than decoding the entire response up front.
+// The hit passed to fn, including its slices, is reused and only valid until fn returns.
+// It returns the pit_id of the response, if any, and the number of hits decoded.
+func DecodeSearchHits(r io.Reader, fn func(*SearchHit) error) (pitID string, n int, err error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return "", 0, err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return "", n, err
+		}
+		switch key {
+		case "pit_id":
+			if err := dec.Decode(&pitID); err != nil {
+				return "", n, err
+			}
+		case "hits":
+			if n, err = decodeHits(dec, fn); err != nil {
+				return "", n, err
+			}
+		default:
+			if err := skipValue(dec); err != nil {
+				return "", n, err
+			}
+		}
+	}
+	return pitID, n, expectDelim(dec, '}')
+}
+
+// decodeHits decodes the outer hits object, streaming each entry of its inner hits array to fn.
+func decodeHits(dec *json.Decoder, fn func(*SearchHit) error) (int, error) {
+	if err := expectDelim(dec, '{'); err != nil {
+		return 0, err
+	}
+	var (
+		n   int
+		hit SearchHit
+	)
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return n, err
+		}
+		if key != "hits" {
+			if err := skipValue(dec); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if err := expectDelim(dec, '['); err != nil {
+			return n, err
+		}
+		for dec.More() {
+			// reset the hit, holding on to the slices' backing arrays
+			counts := hit.Source.DurationHistogram.Counts[:0]
+			values := hit.Source.DurationHistogram.Values[:0]
+			sort := hit.Sort[:0]
+			hit = SearchHit{Sort: sort}
+			hit.Source.DurationHistogram.Counts = counts
+			hit.Source.DurationHistogram.Values = values
+			if err := dec.Decode(&hit); err != nil {
+				return n, err
+			}
+			n++
+			if err := fn(&hit); err != nil {
+				return n, err
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return n, err
+		}
+	}
+	return n, expectDelim(dec, '}')
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != want {
+		return fmt.Errorf("unexpected token %v, expected %v", tok, want)
+	}
+	return nil
+}
+
+// skipValue consumes the next value from dec, whatever its type.
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package metricize
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeSearchHits(t *testing.T) {
+	rsp := `
+{
+	"pit_id": "abc",
+	"took": 1,
+	"_shards": {"total": 1, "successful": 1, "failures": []},
+	"hits": {
+		"total": {"value": 2, "relation": "eq"},
+		"max_score": null,
+		"hits": [
+			{
+				"_index": "metrics-apm.internal-default",
+				"_source": {
+					"service": {"name": "a"},
+					"transaction": {"name": "GET /", "duration.histogram": {"counts": [1, 2], "values": [3, 4]}}
+				},
+				"sort": [1670382900000, 1]
+			},
+			{
+				"_index": "metrics-apm.internal-default",
+				"_source": {
+					"transaction": {"name": "POST /", "duration.histogram": {"counts": [5], "values": [6]}}
+				},
+				"sort": [1670382900001, 2]
+			}
+		]
+	}
+}`
+	var hits []SearchHit
+	pitID, n, err := DecodeSearchHits(strings.NewReader(rsp), func(hit *SearchHit) error {
+		// copy out, the hit is reused
+		var h SearchHit
+		b, err := json.Marshal(hit)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(b, &h))
+		hits = append(hits, h)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "abc", pitID)
+	require.Equal(t, 2, n)
+	require.Len(t, hits, 2)
+
+	require.Equal(t, "a", hits[0].Source.Service.Name)
+	require.Equal(t, DurationHistogram{Counts: []int64{1, 2}, Values: []int64{3, 4}}, hits[0].Source.DurationHistogram)
+	require.Equal(t, []interface{}{float64(1670382900000), float64(1)}, hits[0].Sort)
+
+	require.Empty(t, hits[1].Source.Service.Name)
+	require.Equal(t, "POST /", hits[1].Source.Transaction.Name)
+	require.Equal(t, DurationHistogram{Counts: []int64{5}, Values: []int64{6}}, hits[1].Source.DurationHistogram)
+
+	_, _, err = DecodeSearchHits(strings.NewReader(`{"hits": {"hits": [}}`), func(*SearchHit) error { return nil })
+	require.Error(t, err)
+}
+
+func BenchmarkDecodeSearchHits(b *testing.B) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"pit_id": "abc", "hits": {"total": {"value": 1000}, "hits": [`)
+	for i := 0; i < 1000; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `{"_index": "metrics-apm.internal-default", "_source": {
+			"@timestamp": "2022-12-07T03:15:00.000Z",
+			"service": {"name": "service-%d", "environment": "production", "language": {"name": "go"}},
+			"transaction": {"name": "GET /", "type": "request", "duration.histogram": {
+				"counts": [1, 2, 3, 4, 5, 6, 7, 8], "values": [100, 200, 300, 400, 500, 600, 700, 800]}}
+		}, "sort": [1670382900000, %d]}`, i%10, i)
+	}
+	buf.WriteString(`]}}`)
+	body := buf.Bytes()
+
+	b.Run("full", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			a := NewAggregator(time.Time{})
+			var result struct {
+				PITID string `json:"pit_id"`
+				Hits  struct {
+					Hits []SearchHit `json:"hits"`
+				} `json:"hits"`
+			}
+			if err := json.NewDecoder(bytes.NewReader(body)).Decode(&result); err != nil {
+				b.Fatal(err)
+			}
+			for _, hit := range result.Hits.Hits {
+				if err := a.Aggregate(&hit.Source); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("streaming", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			a := NewAggregator(time.Time{})
+			if _, _, err := DecodeSearchHits(bytes.NewReader(body), func(hit *SearchHit) error {
+				return a.Aggregate(&hit.Source)
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}